@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// activityRequest описывает запрос на запуск, обновление или завершение Live
+// Activity.
+type activityRequest struct {
+	AttributesType string                 `json:"attributesType" form:"attributesType"`
+	Attributes     map[string]interface{} `json:"attributes" form:"attributes"`
+	ContentState   map[string]interface{} `json:"contentState" form:"contentState"`
+	Alert          map[string]interface{} `json:"alert" form:"alert"`
+	Timestamp      time.Time              `json:"timestamp" form:"timestamp"`
+	StaleDate      time.Time              `json:"staleDate" form:"staleDate"`
+	DismissalDate  time.Time              `json:"dismissalDate" form:"dismissalDate"`
+	RelevanceScore float64                `json:"relevanceScore" form:"relevanceScore"`
+	Expiration     time.Time              `json:"expiration" form:"expiration"`
+	LowPriority    bool                   `json:"lowPriority" form:"lowPriority"`
+}
+
+// Notification возвращает уведомление Live Activity с указанным событием:
+// start, update или end.
+func (r *activityRequest) Notification(event, topic string, sandbox bool) Notification {
+	var timestamp = r.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	var aps = map[string]interface{}{
+		"event":     event,
+		"timestamp": timestamp.Unix(),
+	}
+	if r.ContentState != nil {
+		aps["content-state"] = r.ContentState
+	}
+	if event == "start" {
+		aps["attributes-type"] = r.AttributesType
+		aps["attributes"] = r.Attributes
+	}
+	if r.Alert != nil {
+		aps["alert"] = r.Alert
+	}
+	if !r.StaleDate.IsZero() {
+		aps["stale-date"] = r.StaleDate.Unix()
+	}
+	if !r.DismissalDate.IsZero() {
+		aps["dismissal-date"] = r.DismissalDate.Unix()
+	}
+	if r.RelevanceScore != 0 {
+		aps["relevance-score"] = r.RelevanceScore
+	}
+	return Notification{
+		Payload:     map[string]interface{}{"aps": aps},
+		Expiration:  r.Expiration,
+		LowPriority: r.LowPriority,
+		Topic:       topic,
+		Sandbox:     sandbox,
+		PushType:    PushLiveActivity,
+	}
+}
+
+// GetPushToStartTokens отдает список токенов пользователя для запуска Live
+// Activity.
+func (s *Service) GetPushToStartTokens(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	tokens, err := s.config.Store.GetPushToStartTokens(topic, sandbox, user)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("push-to-start tokens for user %s not registered", user))
+	}
+	return c.Write(rest.JSON{"tokens": tokens})
+}
+
+// AddPushToStartToken регистрирует токен пользователя для запуска Live
+// Activity.
+func (s *Service) AddPushToStartToken(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	if err := validateBody(c, "ActivityToken"); err != nil {
+		return err
+	}
+	var token = new(struct {
+		Token string `json:"token" form:"token"`
+	})
+	err := c.Bind(token)
+	if err != nil {
+		return err
+	}
+	if token.Token == "" {
+		return c.Error(http.StatusBadRequest, "empty token")
+	}
+	err = s.config.Store.SavePushToStartToken(user, topic, token.Token, sandbox)
+	if err != nil {
+		return err
+	}
+	tokens, err := s.config.Store.GetPushToStartTokens(topic, sandbox, user)
+	if err != nil {
+		return err
+	}
+	c.SetStatus(http.StatusCreated)
+	return c.Write(rest.JSON{"tokens": tokens})
+}
+
+// AddActivityToken регистрирует токен для обновления Live Activity
+// пользователя с указанным идентификатором.
+func (s *Service) AddActivityToken(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	activity := c.Param("activity") // идентификатор активности
+	if activity == "" {
+		return rest.ErrNotFound
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	if err := validateBody(c, "ActivityToken"); err != nil {
+		return err
+	}
+	var token = new(struct {
+		Token string `json:"token" form:"token"`
+	})
+	err := c.Bind(token)
+	if err != nil {
+		return err
+	}
+	if token.Token == "" {
+		return c.Error(http.StatusBadRequest, "empty token")
+	}
+	err = s.config.Store.SaveActivityToken(user, topic, activity, token.Token,
+		sandbox)
+	if err != nil {
+		return err
+	}
+	c.SetStatus(http.StatusCreated)
+	return c.Write(rest.JSON{"activity": activity, "token": token.Token})
+}
+
+// StartActivity запускает Live Activity на всех устройствах пользователя,
+// используя токены для запуска.
+func (s *Service) StartActivity(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	tokens, err := s.config.Store.GetPushToStartTokens(topic, sandbox, user)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("push-to-start tokens for user %s not registered", user))
+	}
+	if err := validateBody(c, "ActivityRequest"); err != nil {
+		return err
+	}
+	var request = new(activityRequest)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	var n = request.Notification("start", topic, sandbox)
+	if err := n.Validate(); err != nil {
+		return payloadError(c, err)
+	}
+	if err := reserveUsage(c, len(tokens)); err != nil {
+		return err
+	}
+	sent, err := s.config.Push(n, tokens)
+	return writeSent(c, sent, err)
+}
+
+// UpdateActivity отправляет обновление состояния Live Activity.
+func (s *Service) UpdateActivity(c *rest.Context) error {
+	return s.pushActivity(c, "update")
+}
+
+// EndActivity завершает Live Activity и удаляет ее токен.
+func (s *Service) EndActivity(c *rest.Context) error {
+	return s.pushActivity(c, "end")
+}
+
+// pushActivity отправляет событие update или end на токен Live Activity,
+// указанной в пути запроса.
+func (s *Service) pushActivity(c *rest.Context, event string) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	activity := c.Param("activity")       // идентификатор активности
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	owner, token, err := s.config.Store.GetActivityToken(topic, activity, sandbox)
+	if err != nil {
+		return err
+	}
+	if token == "" || owner != user {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("activity %s for user %s not registered", activity, user))
+	}
+	if err := validateBody(c, "ActivityRequest"); err != nil {
+		return err
+	}
+	var request = new(activityRequest)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	var n = request.Notification(event, topic, sandbox)
+	if err := n.Validate(); err != nil {
+		return payloadError(c, err)
+	}
+	if err := reserveUsage(c, 1); err != nil {
+		return err
+	}
+	sent, err := s.config.Push(n, []string{token})
+	if err != nil {
+		return err
+	}
+	// после завершения токен активности больше не нужен
+	if event == "end" {
+		if err := s.config.Store.RemoveActivity(topic, activity, sandbox); err != nil {
+			return err
+		}
+	}
+	return writeSent(c, sent, nil)
+}
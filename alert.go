@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Alert описывает структурированное содержимое уведомления, из которого
+// формируется словарь aps. Имена полей совпадают с ключами APNS.
+type Alert struct {
+	Title             string   `json:"title,omitempty"`
+	Subtitle          string   `json:"subtitle,omitempty"`
+	Body              string   `json:"body,omitempty"`
+	LocKey            string   `json:"loc-key,omitempty"`
+	LocArgs           []string `json:"loc-args,omitempty"`
+	TitleLocKey       string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs      []string `json:"title-loc-args,omitempty"`
+	Sound             *Sound   `json:"sound,omitempty"`
+	Badge             *int     `json:"badge,omitempty"`
+	ThreadID          string   `json:"thread-id,omitempty"`
+	Category          string   `json:"category,omitempty"`
+	MutableContent    bool     `json:"mutable-content,omitempty"`
+	ContentAvailable  bool     `json:"content-available,omitempty"`
+	InterruptionLevel string   `json:"interruption-level,omitempty"`
+	RelevanceScore    *float64 `json:"relevance-score,omitempty"`
+	TargetContentID   string   `json:"target-content-id,omitempty"`
+}
+
+// Sound описывает звук уведомления. Обычный звук задается в JSON строкой с
+// именем файла, а критический — словарем с полями critical, name и volume.
+type Sound struct {
+	Name     string  // имя файла со звуком
+	Critical bool    // критическое уведомление
+	Volume   float64 // громкость критического звука от 0 до 1
+}
+
+// jsonSound описывает звук в виде словаря.
+type jsonSound struct {
+	Critical int     `json:"critical"`
+	Name     string  `json:"name"`
+	Volume   float64 `json:"volume"`
+}
+
+// MarshalJSON возвращает описание звука в формате JSON.
+func (s *Sound) MarshalJSON() ([]byte, error) {
+	if !s.Critical && s.Volume == 0 {
+		return json.Marshal(s.Name)
+	}
+	var sound = &jsonSound{Name: s.Name, Volume: s.Volume}
+	if s.Critical {
+		sound.Critical = 1
+	}
+	return json.Marshal(sound)
+}
+
+// UnmarshalJSON восстанавливает описание звука из строки или словаря.
+func (s *Sound) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Name); err == nil {
+		return nil
+	}
+	var sound = new(jsonSound)
+	if err := json.Unmarshal(data, sound); err != nil {
+		return err
+	}
+	*s = Sound{
+		Name:     sound.Name,
+		Critical: sound.Critical == 1,
+		Volume:   sound.Volume,
+	}
+	return nil
+}
+
+// interruptionLevels содержит допустимые уровни прерывания.
+var interruptionLevels = map[string]bool{
+	"passive":        true,
+	"active":         true,
+	"time-sensitive": true,
+	"critical":       true,
+}
+
+// Validate проверяет корректность значений полей.
+func (a *Alert) Validate() error {
+	if len(a.LocArgs) > 0 && a.LocKey == "" {
+		return PayloadError("alert loc-args requires loc-key")
+	}
+	if len(a.TitleLocArgs) > 0 && a.TitleLocKey == "" {
+		return PayloadError("alert title-loc-args requires title-loc-key")
+	}
+	if a.Badge != nil && *a.Badge < 0 {
+		return PayloadError("alert badge must not be negative")
+	}
+	if a.Sound != nil {
+		if a.Sound.Name == "" {
+			return PayloadError("alert sound requires name")
+		}
+		if a.Sound.Volume < 0 || a.Sound.Volume > 1 {
+			return PayloadError("alert sound volume must be between 0 and 1")
+		}
+	}
+	if a.InterruptionLevel != "" && !interruptionLevels[a.InterruptionLevel] {
+		return PayloadError(fmt.Sprintf("unsupported interruption-level %q",
+			a.InterruptionLevel))
+	}
+	if a.RelevanceScore != nil &&
+		(*a.RelevanceScore < 0 || *a.RelevanceScore > 1) {
+		return PayloadError("alert relevance-score must be between 0 and 1")
+	}
+	return nil
+}
+
+// APS возвращает словарь aps, сформированный из заданных полей.
+func (a *Alert) APS() map[string]interface{} {
+	var alert = make(map[string]interface{})
+	for key, value := range map[string]string{
+		"title":         a.Title,
+		"subtitle":      a.Subtitle,
+		"body":          a.Body,
+		"loc-key":       a.LocKey,
+		"title-loc-key": a.TitleLocKey,
+	} {
+		if value != "" {
+			alert[key] = value
+		}
+	}
+	if len(a.LocArgs) > 0 {
+		alert["loc-args"] = a.LocArgs
+	}
+	if len(a.TitleLocArgs) > 0 {
+		alert["title-loc-args"] = a.TitleLocArgs
+	}
+	var aps = make(map[string]interface{})
+	if len(alert) > 0 {
+		aps["alert"] = alert
+	}
+	if a.Sound != nil {
+		aps["sound"] = a.Sound
+	}
+	if a.Badge != nil {
+		aps["badge"] = *a.Badge
+	}
+	for key, value := range map[string]string{
+		"thread-id":          a.ThreadID,
+		"category":           a.Category,
+		"interruption-level": a.InterruptionLevel,
+		"target-content-id":  a.TargetContentID,
+	} {
+		if value != "" {
+			aps[key] = value
+		}
+	}
+	if a.MutableContent {
+		aps["mutable-content"] = 1
+	}
+	if a.ContentAvailable {
+		aps["content-available"] = 1
+	}
+	if a.RelevanceScore != nil {
+		aps["relevance-score"] = *a.RelevanceScore
+	}
+	return aps
+}
+
+// Merge возвращает новое содержимое уведомления, в котором к пользовательским
+// ключам payload добавлен словарь aps. Значения из Alert заменяют одноименные
+// ключи aps, заданные в payload.
+func (a *Alert) Merge(payload map[string]interface{}) map[string]interface{} {
+	var result = make(map[string]interface{}, len(payload)+1)
+	for key, value := range payload {
+		result[key] = value
+	}
+	var aps = make(map[string]interface{})
+	if current, ok := payload["aps"].(map[string]interface{}); ok {
+		for key, value := range current {
+			aps[key] = value
+		}
+	}
+	for key, value := range a.APS() {
+		aps[key] = value
+	}
+	result["aps"] = aps
+	return result
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/mdigger/rest"
+)
+
+// apiVersion — версия API, в которой ошибки отдаются в виде apiError.
+// Клиенты запрашивают ее заголовком X-API-Version, остальные получают ошибки
+// в прежнем виде.
+const apiVersion = "1.2"
+
+// isAPIVersion возвращает true, если запрошенная клиентом версия API не ниже
+// указанной.
+func isAPIVersion(r *http.Request, version string) bool {
+	var major, minor, wantMajor, wantMinor int
+	if _, err := fmt.Sscanf(r.Header.Get("X-API-Version"), "%d.%d",
+		&major, &minor); err != nil {
+		return false
+	}
+	fmt.Sscanf(version, "%d.%d", &wantMajor, &wantMinor)
+	return major > wantMajor || major == wantMajor && minor >= wantMinor
+}
+
+// apiError описывает ошибку в ответе сервиса. Reason содержит причину ошибки
+// APNS, Tokens — статусы отправки на токены, обработанные до ошибки, а Fields
+// — поля тела запроса, не соответствующие описанию API.
+type apiError struct {
+	Code    int           `json:"code"`
+	Reason  string        `json:"reason,omitempty"`
+	Message string        `json:"message"`
+	Tokens  []tokenStatus `json:"tokens,omitempty"`
+	Fields  []fieldError  `json:"fields,omitempty"`
+}
+
+// tokenStatus описывает статус отправки уведомления на токен устройства.
+type tokenStatus struct {
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+// pushError описывает ошибку APNS, прервавшую отправку уведомлений, и статусы
+// отправки на уже обработанные токены.
+type pushError struct {
+	apns *Error
+	sent map[string]string
+}
+
+func (e *pushError) Error() string { return e.apns.Error() }
+
+// delivered возвращает true, если до ошибки хотя бы одно уведомление было
+// отправлено или отложено для отправки.
+func (e *pushError) delivered() bool {
+	for _, status := range e.sent {
+		if status == "OK" || status == StatusThrottled {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIError возвращает описание ошибки для ответа сервиса.
+func newAPIError(err error) *apiError {
+	switch err := err.(type) {
+	case *pushError:
+		var result = newAPIError(err.apns)
+		for token, status := range err.sent {
+			result.Tokens = append(result.Tokens, tokenStatus{token, status})
+		}
+		sort.Slice(result.Tokens, func(i, j int) bool {
+			return result.Tokens[i].Token < result.Tokens[j].Token
+		})
+		return result
+	case *Error:
+		return &apiError{
+			Code:    err.HTTPStatus(),
+			Reason:  err.Reason,
+			Message: err.Error(),
+		}
+	case validationError:
+		return &apiError{
+			Code:    http.StatusBadRequest,
+			Message: "request body does not match the API description",
+			Fields:  err,
+		}
+	case *rest.Error:
+		return &apiError{Code: err.Code, Message: err.Message}
+	default:
+		return &apiError{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+}
+
+// writeError отдает ошибку обработчика запроса в виде apiError.
+func writeError(c *rest.Context, err error) error {
+	var apierr = newAPIError(err)
+	c.SetStatus(apierr.Code)
+	c.SetHeader("Content-Type", "application/json; charset=utf-8")
+	c.Response.WriteHeader(apierr.Code)
+	return json.NewEncoder(c.Response).Encode(rest.JSON{
+		"code":    apierr.Code,
+		"status":  http.StatusText(apierr.Code),
+		"success": false,
+		"error":   apierr,
+	})
+}
+
+// writePushError отдает ошибку отправки клиентам прежних версий API: ошибка
+// в прежнем виде дополняется статусами отправки на уже обработанные токены.
+func writePushError(c *rest.Context, err *pushError) error {
+	var code = http.StatusInternalServerError
+	c.SetStatus(code)
+	c.SetHeader("Content-Type", "application/json; charset=utf-8")
+	c.Response.WriteHeader(code)
+	return json.NewEncoder(c.Response).Encode(rest.JSON{
+		"code":    code,
+		"status":  http.StatusText(code),
+		"success": false,
+		"error":   err.Error(),
+		"sent":    err.sent,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+func TestAPIError(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.apns.Respond("BBBB", mockapns.Response{
+		Status: http.StatusBadRequest,
+		Reason: "BadTopic",
+	})
+	// push отправляет уведомление с указанной версией API и возвращает ответ
+	push := func(version, user string) (*http.Response, *apiError) {
+		t.Helper()
+		data, err := json.Marshal(testPayload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", ts.server.URL+"/apns/"+testTopic+
+			"/users/"+user+"/push", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if version != "" {
+			req.Header.Set("X-API-Version", version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Error *apiError `json:"error"`
+		}
+		if version != "" {
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, result.Error
+	}
+	// прежние клиенты получают ошибку в прежнем виде
+	if resp, _ := push("", "dmitrys"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("version 1.1 status: %d", resp.StatusCode)
+	}
+	resp, apierr := push("1.2", "dmitrys")
+	if resp.StatusCode != http.StatusBadRequest ||
+		resp.Header.Get("X-API-Version") != apiVersion {
+		t.Errorf("version 1.2 status: %d, %v", resp.StatusCode, resp.Header)
+	}
+	if apierr == nil || apierr.Code != http.StatusBadRequest ||
+		apierr.Reason != "BadTopic" || apierr.Message != reasons["BadTopic"] {
+		t.Fatalf("error: %+v", apierr)
+	}
+	if len(apierr.Tokens) != 2 || apierr.Tokens[0] != (tokenStatus{"AAAA", "OK"}) ||
+		apierr.Tokens[1] != (tokenStatus{"BBBB", reasons["BadTopic"]}) {
+		t.Errorf("tokens: %+v", apierr.Tokens)
+	}
+	// ошибки запроса отдаются в том же виде
+	resp, apierr = push("1.2", "test")
+	if resp.StatusCode != http.StatusNotFound || apierr == nil ||
+		apierr.Code != http.StatusNotFound || apierr.Message == "" {
+		t.Errorf("not found: %d, %+v", resp.StatusCode, apierr)
+	}
+}
+
+func TestErrorHTTPStatus(t *testing.T) {
+	for reason, status := range map[string]int{
+		"BadDeviceToken":       http.StatusBadRequest,
+		"TopicDisallowed":      http.StatusForbidden,
+		"PayloadTooLarge":      http.StatusRequestEntityTooLarge,
+		"TooManyRequests":      http.StatusTooManyRequests,
+		"ServiceUnavailable":   http.StatusServiceUnavailable,
+		"InvalidProviderToken": http.StatusBadGateway,
+	} {
+		if got := (&Error{Reason: reason}).HTTPStatus(); got != status {
+			t.Errorf("%s: status %d, want %d", reason, got, status)
+		}
+	}
+}
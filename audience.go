@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Audience описывает логическое выражение над тегами пользователей и токенов
+// для выбора получателей push-уведомления. В каждом узле выражения должно быть
+// задано ровно одно из полей:
+//
+//	{"and":[{"tag":"beta"},{"not":{"tag":"lang:de"}}]}
+type Audience struct {
+	Tag string      `json:"tag,omitempty"` // наличие тега
+	And []*Audience `json:"and,omitempty"` // все условия выполняются
+	Or  []*Audience `json:"or,omitempty"`  // хотя бы одно условие выполняется
+	Not *Audience   `json:"not,omitempty"` // условие не выполняется
+}
+
+// ErrBadAudience возвращается при ошибке в выражении для выбора получателей.
+var ErrBadAudience = errors.New("bad audience expression")
+
+// ErrNegativeAudience возвращается для выражения, которому соответствуют
+// токены без тегов, например состоящего только из отрицания: такое выражение
+// выбирало бы почти все токены темы.
+var ErrNegativeAudience = errors.New("audience expression requires a tag")
+
+// Validate проверяет корректность выражения. Выражение должно требовать
+// наличия хотя бы одного тега.
+func (a *Audience) Validate() error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	if a.Match(nil) {
+		return ErrNegativeAudience
+	}
+	return nil
+}
+
+// validate проверяет корректность узла выражения и вложенных в него условий.
+func (a *Audience) validate() error {
+	if a == nil {
+		return ErrBadAudience
+	}
+	var count int
+	if a.Tag != "" {
+		count++
+	}
+	if a.And != nil {
+		count++
+	}
+	if a.Or != nil {
+		count++
+	}
+	if a.Not != nil {
+		count++
+	}
+	if count != 1 {
+		return ErrBadAudience
+	}
+	for _, list := range [][]*Audience{a.And, a.Or} {
+		if list != nil && len(list) == 0 {
+			return ErrBadAudience
+		}
+		for _, item := range list {
+			if err := item.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if a.Not != nil {
+		return a.Not.validate()
+	}
+	return nil
+}
+
+// Match возвращает true, если набор тегов удовлетворяет выражению.
+func (a *Audience) Match(tags map[string]struct{}) bool {
+	switch {
+	case a.Tag != "":
+		_, ok := tags[a.Tag]
+		return ok
+	case a.And != nil:
+		for _, item := range a.And {
+			if !item.Match(tags) {
+				return false
+			}
+		}
+		return true
+	case a.Or != nil:
+		for _, item := range a.Or {
+			if item.Match(tags) {
+				return true
+			}
+		}
+		return false
+	case a.Not != nil:
+		return !a.Not.Match(tags)
+	default:
+		return false
+	}
+}
+
+// normalizeTags возвращает отсортированный список тегов без пробелов по
+// краям, пустых значений и повторов.
+func normalizeTags(tags []string) []string {
+	var (
+		list   = make([]string, 0, len(tags))
+		unique = make(map[string]struct{}, len(tags))
+	)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if _, ok := unique[tag]; ok {
+			continue
+		}
+		unique[tag] = struct{}{}
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAudienceValidate(t *testing.T) {
+	for expr, want := range map[string]error{
+		`{"tag":"beta"}`: nil,
+		`{"and":[{"tag":"beta"},{"not":{"tag":"lang:de"}}]}`: nil,
+		`{"not":{"not":{"tag":"beta"}}}`:                     nil,
+		`{"or":[{"tag":"beta"},{"tag":"plan:pro"}]}`:         nil,
+		`{}`:                                     ErrBadAudience,
+		`{"tag":"beta","not":{"tag":"lang:de"}}`: ErrBadAudience,
+		`{"and":[]}`:                             ErrBadAudience,
+		`{"and":[{"tag":"beta"},{}]}`:            ErrBadAudience,
+		// выражения, которым соответствуют токены без тегов
+		`{"not":{"tag":"lang:de"}}`:                            ErrNegativeAudience,
+		`{"or":[{"tag":"beta"},{"not":{"tag":"lang:de"}}]}`:    ErrNegativeAudience,
+		`{"and":[{"not":{"tag":"beta"}},{"not":{"tag":"x"}}]}`: ErrNegativeAudience,
+	} {
+		var audience = new(Audience)
+		if err := json.Unmarshal([]byte(expr), audience); err != nil {
+			t.Fatal(err)
+		}
+		if err := audience.Validate(); err != want {
+			t.Errorf("%s: %v, want %v", expr, err, want)
+		}
+	}
+}
+
+func TestPushAudience(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.addTokens("test", false, "CCCC")
+	var path = "/apns/" + testTopic
+	ts.expect(http.StatusOK, "PUT", path+"/users/dmitrys/tags",
+		map[string][]string{"tags": {"beta"}})
+	ts.expect(http.StatusOK, "PUT", path+"/tokens/BBBB/tags",
+		map[string][]string{"tags": {"lang:de"}})
+	ts.expect(http.StatusOK, "PUT", path+"/tokens/CCCC/tags",
+		map[string][]string{"tags": {"beta"}})
+	var result struct {
+		Sent map[string]string `json:"sent"`
+	}
+	ts.expect(http.StatusOK, "POST", path+"/push", map[string]interface{}{
+		"payload": testPayload["payload"],
+		"audience": map[string]interface{}{"and": []interface{}{
+			map[string]string{"tag": "beta"},
+			map[string]interface{}{"not": map[string]string{"tag": "lang:de"}},
+		}},
+	}).Decode(t, &result)
+	if len(result.Sent) != 2 || result.Sent["AAAA"] != "OK" || result.Sent["CCCC"] != "OK" {
+		t.Errorf("sent: %v", result.Sent)
+	}
+	// одно отрицание выбрало бы все токены темы
+	ts.expect(http.StatusBadRequest, "POST", path+"/push", map[string]interface{}{
+		"payload":  testPayload["payload"],
+		"audience": map[string]interface{}{"not": map[string]string{"tag": "lang:de"}},
+	})
+	// теги незарегистрированного токена не сохраняются
+	ts.expect(http.StatusNotFound, "PUT", path+"/tokens/DDDD/tags",
+		map[string][]string{"tags": {"beta"}})
+	ts.expect(http.StatusNotFound, "PUT", path+"/tokens/AAAA/tags?sandbox",
+		map[string][]string{"tags": {"beta"}})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mdigger/rest"
+)
+
+// BadgeIncrement — значение aps.badge, которое заменяется увеличенным на
+// единицу счетчиком непрочитанных уведомлений пользователя.
+const BadgeIncrement = "increment"
+
+// StatusNoBadge — статус токена без пользователя, на который не отправлено
+// уведомление, содержащее только увеличение счетчика.
+const StatusNoBadge = "nobadge"
+
+// badgeIncrement возвращает true, если в содержимом уведомления aps.badge
+// задан как BadgeIncrement.
+func badgeIncrement(payload interface{}) bool {
+	data, ok := payload.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	aps, ok := data["aps"].(map[string]interface{})
+	return ok && aps["badge"] == BadgeIncrement
+}
+
+// withBadge возвращает копию содержимого уведомления с указанным значением
+// aps.badge. Отрицательное значение удаляет aps.badge.
+func withBadge(payload interface{}, badge int64) interface{} {
+	data, ok := payload.(map[string]interface{})
+	if !ok {
+		return payload
+	}
+	var result = make(map[string]interface{}, len(data))
+	for key, value := range data {
+		result[key] = value
+	}
+	var aps = make(map[string]interface{})
+	if current, ok := data["aps"].(map[string]interface{}); ok {
+		for key, value := range current {
+			aps[key] = value
+		}
+	}
+	if badge < 0 {
+		delete(aps, "badge")
+	} else {
+		aps["badge"] = badge
+	}
+	result["aps"] = aps
+	return result
+}
+
+// badgeCounter увеличивает счетчики непрочитанных уведомлений пользователей
+// один раз на запрос отправки, сколько бы устройств у них ни было.
+type badgeCounter struct {
+	store  *Store
+	topic  string
+	users  map[string]string // пользователи токенов
+	badges map[string]int64  // увеличенные счетчики пользователей
+}
+
+// newBadgeCounter возвращает счетчик для токенов темы.
+func (c *Config) newBadgeCounter(topic string, sandbox bool,
+	tokens []string) (*badgeCounter, error) {
+	users, err := c.Store.GetTokensUsers(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	return &badgeCounter{
+		store:  c.Store,
+		topic:  topic,
+		users:  users,
+		badges: make(map[string]int64),
+	}, nil
+}
+
+// Badge возвращает увеличенный счетчик пользователя токена. Для токена без
+// пользователя возвращается -1.
+func (b *badgeCounter) Badge(token string) (int64, error) {
+	user, ok := b.users[token]
+	if !ok {
+		return -1, nil
+	}
+	if badge, ok := b.badges[user]; ok {
+		return badge, nil
+	}
+	badge, err := b.store.AddBadge(b.topic, user, 1)
+	if err != nil {
+		return 0, err
+	}
+	b.badges[user] = badge
+	return badge, nil
+}
+
+// badgeParams проверяет авторизацию пользователя и возвращает тему и
+// пользователя запроса.
+func (s *Service) badgeParams(c *rest.Context) (topic, user string, err error) {
+	if err = s.UserAuth(c); err != nil {
+		return
+	}
+	user = c.Param("login")  // логин пользователя
+	topic = c.Param("topic") // тема
+	if user == "" || topic == "" {
+		err = rest.ErrNotFound
+	}
+	return
+}
+
+// GetBadge отдает счетчик непрочитанных уведомлений пользователя.
+func (s *Service) GetBadge(c *rest.Context) error {
+	topic, user, err := s.badgeParams(c)
+	if err != nil {
+		return err
+	}
+	badge, err := s.config.Store.GetBadge(topic, user)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"badge": badge})
+}
+
+// SetBadge устанавливает счетчик непрочитанных уведомлений пользователя.
+func (s *Service) SetBadge(c *rest.Context) error {
+	topic, user, err := s.badgeParams(c)
+	if err != nil {
+		return err
+	}
+	var request = new(struct {
+		Badge int64 `json:"badge" form:"badge"`
+	})
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	if request.Badge < 0 {
+		return c.Error(http.StatusBadRequest, "badge must not be negative")
+	}
+	return s.updateBadge(c, topic, user, request.Badge)
+}
+
+// ResetBadge сбрасывает счетчик непрочитанных уведомлений пользователя.
+func (s *Service) ResetBadge(c *rest.Context) error {
+	topic, user, err := s.badgeParams(c)
+	if err != nil {
+		return err
+	}
+	return s.updateBadge(c, topic, user, 0)
+}
+
+// badgePush возвращает обработчик изменения счетчика, который проверяет
+// ограничения отправки так же, как запросы на отправку уведомлений, если в
+// запросе указан параметр push.
+func (s *Service) badgePush(handler rest.Handler) rest.Handler {
+	var limited = s.limited(s.UserAuth, handler)
+	return func(c *rest.Context) error {
+		if len(c.Request.URL.Query()["push"]) == 0 {
+			return handler(c)
+		}
+		return limited(c)
+	}
+}
+
+// updateBadge сохраняет счетчик пользователя и, если в запросе указан
+// параметр push, отправляет на все устройства пользователя беззвучное
+// уведомление с новым значением.
+func (s *Service) updateBadge(c *rest.Context, topic, user string,
+	badge int64) error {
+	query := c.Request.URL.Query()
+	if len(query["push"]) == 0 {
+		if err := s.config.Store.SetBadge(topic, user, badge); err != nil {
+			return err
+		}
+		return c.Write(rest.JSON{"badge": badge})
+	}
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	tokens, err := s.config.Store.GetUserTopicTokens(topic, sandbox, user)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("tokens for user %s not registered", user))
+	}
+	if err := reserveUsage(c, len(tokens)); err != nil {
+		return err
+	}
+	if err := s.config.Store.SetBadge(topic, user, badge); err != nil {
+		return err
+	}
+	sent, err := s.config.Push(Notification{
+		Payload: map[string]interface{}{
+			"aps": map[string]interface{}{"badge": badge},
+		},
+		Topic:       topic,
+		Sandbox:     sandbox,
+		PushType:    PushAlert,
+		LowPriority: true,
+	}, tokens)
+	if apnserr, ok := err.(*Error); ok {
+		return &pushError{apns: apnserr, sent: sent}
+	}
+	if err != nil {
+		return err
+	}
+	countUsage(c, len(sent))
+	return c.Write(rest.JSON{"badge": badge, "sent": sent})
+}
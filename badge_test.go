@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestBadge(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.addTokens("test", false, "CCCC")
+	var path = "/apns/" + testTopic + "/users/dmitrys/badge"
+	// badges возвращает значения aps.badge отправленных уведомлений по токенам
+	badges := func() map[string]interface{} {
+		t.Helper()
+		var result = make(map[string]interface{})
+		for _, request := range ts.apns.Requests() {
+			var payload struct {
+				APS map[string]interface{} `json:"aps"`
+			}
+			if err := json.Unmarshal(request.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			result[request.Token] = payload.APS["badge"]
+		}
+		ts.apns.Reset()
+		return result
+	}
+	// badge возвращает счетчик пользователя
+	badge := func() int64 {
+		t.Helper()
+		var result struct {
+			Badge int64 `json:"badge"`
+		}
+		ts.expect(http.StatusOK, "GET", path, nil).Decode(t, &result)
+		return result.Badge
+	}
+	var increment = map[string]interface{}{
+		"aps": map[string]interface{}{"alert": "Test", "badge": BadgeIncrement},
+	}
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/push",
+		map[string]interface{}{
+			"payload": increment,
+			"users":   []string{"dmitrys", "test"},
+		})
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		map[string]interface{}{"payload": increment})
+	// в badges остаются последние значения для каждого токена
+	if got := badges(); got["AAAA"] != 2.0 || got["BBBB"] != 2.0 || got["CCCC"] != 1.0 {
+		t.Errorf("incremented badges: %v", got)
+	}
+	if n := badge(); n != 2 {
+		t.Errorf("badge: %d", n)
+	}
+	// счетчики пользователей независимы
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/test/push",
+		map[string]interface{}{"payload": increment})
+	if got := badges(); got["CCCC"] != 2.0 {
+		t.Errorf("other user badge: %v", got)
+	}
+	ts.expect(http.StatusOK, "PUT", path, map[string]interface{}{"badge": 5})
+	if n := badge(); n != 5 {
+		t.Errorf("badge after set: %d", n)
+	}
+	ts.expect(http.StatusBadRequest, "PUT", path, map[string]interface{}{"badge": -1})
+	// сброс без уведомления
+	ts.expect(http.StatusOK, "DELETE", path, nil)
+	if n := len(ts.apns.Requests()); n != 0 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// сброс с беззвучным уведомлением на все устройства
+	ts.expect(http.StatusOK, "PUT", path, map[string]interface{}{"badge": 3})
+	ts.expect(http.StatusOK, "DELETE", path+"?push", nil)
+	requests := ts.apns.Requests()
+	if got := badges(); got["AAAA"] != 0.0 || got["BBBB"] != 0.0 || len(got) != 2 {
+		t.Errorf("reset badges: %v", got)
+	}
+	for _, request := range requests {
+		if priority := request.Header.Get("apns-priority"); priority != "5" {
+			t.Errorf("reset priority: %q", priority)
+		}
+	}
+	if n := badge(); n != 0 {
+		t.Errorf("badge after reset: %d", n)
+	}
+}
+
+func TestBadgeNoUser(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	// счетчик не учитывает токен, который не принадлежит пользователю
+	var state = &deliveryState{
+		badges: &badgeCounter{
+			store:  ts.config.Store,
+			topic:  testTopic,
+			users:  map[string]string{"AAAA": "dmitrys"},
+			badges: make(map[string]int64),
+		},
+	}
+	for payload, want := range map[string]string{
+		`{"aps":{"badge":"increment"}}`:                StatusNoBadge,
+		`{"aps":{"alert":"Test","badge":"increment"}}`: "OK",
+	} {
+		ts.apns.Reset()
+		var n = Notification{Topic: testTopic}
+		if err := json.Unmarshal([]byte(payload), &n.Payload); err != nil {
+			t.Fatal(err)
+		}
+		sent, err := ts.service.pushTokens(n, []string{"AAAA", "BBBB"}, state)
+		if err != nil || sent["AAAA"] != "OK" || sent["BBBB"] != want {
+			t.Errorf("%s: %v, %v", payload, sent, err)
+		}
+		for _, request := range ts.apns.Requests() {
+			if request.Token == "BBBB" && want != "OK" {
+				t.Errorf("%s: sent without badge", payload)
+			}
+		}
+	}
+}
+
+func TestBadgePushLimited(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Limits = &LimitsConfig{Topics: map[string]*Limit{"*": {Quota: 1}}}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	var path = "/apns/" + testTopic + "/users/dmitrys/badge"
+	// без отправки счетчик меняется без ограничений
+	ts.expect(http.StatusOK, "PUT", path, map[string]interface{}{"badge": 3})
+	ts.expect(http.StatusOK, "DELETE", path, nil)
+	// уведомления на два устройства не помещаются в квоту
+	ts.expect(http.StatusTooManyRequests, "DELETE", path+"?push", nil)
+	if n := len(ts.apns.Requests()); n != 0 {
+		t.Errorf("apns requests: %d", n)
+	}
+}
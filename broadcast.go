@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// BroadcastConfig описывает настройки по умолчанию для рассылки уведомлений
+// на все токены темы.
+type BroadcastConfig struct {
+	Rate     float64 `json:"rate,omitempty"`     // уведомлений в секунду
+	Workers  int     `json:"workers,omitempty"`  // параллельных отправок
+	PageSize int     `json:"pageSize,omitempty"` // токенов на страницу
+}
+
+// defaultPageSize задает количество токенов, читаемых из хранилища за раз.
+const defaultPageSize = 500
+
+// Статусы фоновой задачи.
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobCancelled = "cancelled"
+	JobFailed    = "failed"
+)
+
+// Job описывает фоновую задачу рассылки уведомления на все токены темы.
+// Состояние задачи сохраняется в хранилище после обработки каждой страницы
+// токенов, а также при остановке и ошибке: Cursor содержит последний токен,
+// до которого включительно обработаны все токены, а Done — токены после него,
+// уже обработанные параллельными отправками. Поэтому прерванная задача
+// продолжается без повторной отправки.
+type Job struct {
+	ID           string       `json:"id"`
+	Topic        string       `json:"topic"`
+	Sandbox      bool         `json:"sandbox,omitempty"`
+	Notification Notification `json:"notification"`
+	Rate         float64      `json:"rate,omitempty"`
+	Workers      int          `json:"workers,omitempty"`
+	PageSize     int          `json:"pageSize,omitempty"`
+	Status       string       `json:"status"`
+	Error        string       `json:"error,omitempty"`
+	Cursor       string       `json:"cursor,omitempty"`
+	Done         []string     `json:"done,omitempty"` // обработанные после курсора
+	Total        int          `json:"total"`
+	Sent         int          `json:"sent"`
+	Throttled    int          `json:"throttled,omitempty"` // отложены до отправки
+	Failed       int          `json:"failed"`
+	Created      time.Time    `json:"created"`
+	Updated      time.Time    `json:"updated"`
+}
+
+// newJobID возвращает новый уникальный идентификатор задачи.
+func newJobID() string {
+	var id = make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// ErrJobRunning возвращается при попытке запустить уже выполняющуюся задачу.
+var ErrJobRunning = errors.New("job is already running")
+
+// jobRunner управляет выполнением фоновых задач рассылки.
+type jobRunner struct {
+	config  *Config
+	running map[string]chan struct{} // каналы остановки выполняющихся задач
+	mu      sync.Mutex
+}
+
+// newJobRunner возвращает новый обработчик фоновых задач.
+func newJobRunner(config *Config) *jobRunner {
+	return &jobRunner{
+		config:  config,
+		running: make(map[string]chan struct{}),
+	}
+}
+
+// Resume запускает все задачи, выполнение которых было прервано остановкой
+// сервиса.
+func (r *jobRunner) Resume() error {
+	jobs, err := r.config.Store.GetJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Status != JobRunning {
+			continue
+		}
+		log.WithField("job", job.ID).Info("resume broadcast")
+		if err := r.Start(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start запускает выполнение задачи в фоне.
+func (r *jobRunner) Start(job *Job) error {
+	r.mu.Lock()
+	if _, ok := r.running[job.ID]; ok {
+		r.mu.Unlock()
+		return ErrJobRunning
+	}
+	stop := make(chan struct{})
+	r.running[job.ID] = stop
+	r.mu.Unlock()
+	job.Status = JobRunning
+	job.Error = ""
+	job.Updated = time.Now().UTC()
+	if err := r.config.Store.SaveJob(job); err != nil {
+		r.done(job.ID, stop)
+		return err
+	}
+	var state = *job // задача изменяется только в обработчике
+	go r.run(&state, stop)
+	return nil
+}
+
+// Cancel останавливает выполнение задачи. Возвращает false, если задача не
+// выполняется. Задача остается в списке выполняющихся, пока ее обработчик не
+// завершит работу, поэтому запустить ее повторно до этого нельзя.
+func (r *jobRunner) Cancel(id string) bool {
+	r.mu.Lock()
+	stop, ok := r.running[id]
+	if ok {
+		select {
+		case <-stop: // уже остановлена
+		default:
+			close(stop)
+		}
+	}
+	r.mu.Unlock()
+	return ok
+}
+
+// IsRunning возвращает true, если задача выполняется.
+func (r *jobRunner) IsRunning(id string) bool {
+	r.mu.Lock()
+	_, ok := r.running[id]
+	r.mu.Unlock()
+	return ok
+}
+
+// done удаляет задачу из списка выполняющихся, если она зарегистрирована с
+// указанным каналом остановки.
+func (r *jobRunner) done(id string, stop chan struct{}) {
+	r.mu.Lock()
+	if r.running[id] == stop {
+		delete(r.running, id)
+	}
+	r.mu.Unlock()
+}
+
+// run выполняет рассылку уведомления постранично, начиная с токена, следующего
+// за сохраненным в задаче курсором.
+func (r *jobRunner) run(job *Job, stop chan struct{}) {
+	defer r.done(job.ID, stop)
+	ctxlog := log.WithFields(log.Fields{
+		"job":     job.ID,
+		"topic":   job.Topic,
+		"sandbox": job.Sandbox,
+	})
+	ctxlog.Info("broadcast started")
+	var pageSize = job.PageSize
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	var limiter = NewLimiter(job.Rate, int(job.Rate))
+	// finish сохраняет окончательный статус задачи
+	finish := func(status string, err error) {
+		job.Status = status
+		if err != nil {
+			job.Error = err.Error()
+		}
+		job.Updated = time.Now().UTC()
+		if err := r.config.Store.SaveJob(job); err != nil {
+			ctxlog.WithError(err).Error("save job error")
+		}
+		ctxlog.WithFields(log.Fields{
+			"status":    job.Status,
+			"sent":      job.Sent,
+			"throttled": job.Throttled,
+			"failed":    job.Failed,
+		}).WithError(err).Info("broadcast finished")
+		if status != JobCancelled {
+			r.config.emit(EventJobCompleted, job.Topic, job)
+		}
+	}
+	for {
+		page, err := r.config.Store.GetTokensPage(job.Topic, job.Sandbox,
+			job.Cursor, pageSize)
+		if err != nil {
+			finish(JobFailed, err)
+			return
+		}
+		if len(page) == 0 {
+			finish(JobCompleted, nil)
+			return
+		}
+		// передаем токены страницы на отправку, пропуская уже обработанные
+		var (
+			halt      = make(chan struct{}) // остановка отправки страницы
+			halted    sync.Once
+			pageDone  = make(chan struct{})
+			processed = make(map[string]bool, len(page))
+			pending   = make([]string, 0, len(page))
+			tokens    = make(chan string)
+		)
+		for _, token := range job.Done {
+			processed[token] = true
+		}
+		for _, token := range page {
+			if !processed[token] {
+				pending = append(pending, token)
+			}
+		}
+		stopPage := func() { halted.Do(func() { close(halt) }) }
+		go func() {
+			select {
+			case <-stop:
+				stopPage()
+			case <-pageDone:
+			}
+		}()
+		go func() {
+			defer close(tokens)
+			for _, token := range pending {
+				select {
+				case tokens <- token:
+				case <-halt:
+					return
+				}
+			}
+		}()
+		var fatal error // ошибка, после которой отправка невозможна
+		for result := range r.config.PushStream(job.Notification, tokens,
+			job.Workers, limiter, halt) {
+			processed[result.Token] = true
+			if result.Err != nil && fatal == nil {
+				fatal = result.Err
+				stopPage() // остальные токены страницы не отправляются
+			}
+			switch result.Status {
+			case "OK":
+				job.Sent++
+			case StatusThrottled: // будут отправлены позже
+				job.Throttled++
+			default:
+				job.Failed++
+			}
+		}
+		close(pageDone)
+		// сохраняем обработанную часть страницы
+		job.Done = nil
+		for i, token := range page {
+			if !processed[token] {
+				for _, token := range page[i+1:] {
+					if processed[token] {
+						job.Done = append(job.Done, token)
+					}
+				}
+				break
+			}
+			job.Cursor = token
+		}
+		select {
+		case <-stop:
+			finish(JobCancelled, nil)
+			return
+		default:
+		}
+		if fatal != nil {
+			finish(JobFailed, fatal)
+			return
+		}
+		job.Updated = time.Now().UTC()
+		if err := r.config.Store.SaveJob(job); err != nil {
+			finish(JobFailed, err)
+			return
+		}
+	}
+}
+
+// broadcastRequest описывает запрос на рассылку уведомления на все токены
+// темы.
+type broadcastRequest struct {
+	pushRequest
+	Rate    float64 `json:"rate" form:"rate"`
+	Workers int     `json:"workers" form:"workers"`
+}
+
+// Broadcast запускает фоновую рассылку push-уведомления на все
+// зарегистрированные токены темы.
+func (s *Service) Broadcast(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	// разбираем запроса для отправки уведомления
+	if err := validateBody(c, "BroadcastRequest"); err != nil {
+		return err
+	}
+	var notification = new(broadcastRequest)
+	err := c.Bind(notification)
+	if err != nil {
+		return err
+	}
+	// рассылка отправляет на все токены одно и то же уведомление
+	if notification.Template != "" {
+		return c.Error(http.StatusBadRequest,
+			"templates are not supported for broadcast")
+	}
+	n, err := notification.Notification(topic, sandbox)
+	if err != nil {
+		return payloadError(c, err)
+	}
+	total, err := s.config.Store.CountTokens(topic, sandbox)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return c.Error(http.StatusNotFound, "tokens not registered")
+	}
+	// формируем задачу, подставляя настройки по умолчанию
+	var defaults = s.config.Broadcast
+	if defaults == nil {
+		defaults = new(BroadcastConfig)
+	}
+	var now = time.Now().UTC()
+	var job = &Job{
+		ID:           newJobID(),
+		Topic:        topic,
+		Sandbox:      sandbox,
+		Notification: n,
+		Rate:         notification.Rate,
+		Workers:      notification.Workers,
+		PageSize:     defaults.PageSize,
+		Total:        total,
+		Created:      now,
+	}
+	// скорость рассылки из запроса не может превышать заданную в конфигурации
+	if job.Rate <= 0 || (defaults.Rate > 0 && job.Rate > defaults.Rate) {
+		job.Rate = defaults.Rate
+	}
+	if job.Workers <= 0 {
+		job.Workers = defaults.Workers
+	}
+	if err := s.jobs.Start(job); err != nil {
+		return err
+	}
+	c.SetStatus(http.StatusAccepted)
+	return c.Write(rest.JSON{"job": job})
+}
+
+// GetJobs отдает список задач рассылки для темы.
+func (s *Service) GetJobs(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	topic := c.Param("topic") // тема
+	jobs, err := s.config.Store.GetJobs()
+	if err != nil {
+		return err
+	}
+	var list = make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Topic == topic {
+			list = append(list, job)
+		}
+	}
+	return c.Write(rest.JSON{"jobs": list})
+}
+
+// job возвращает задачу рассылки темы, указанную в пути запроса.
+func (s *Service) job(c *rest.Context) (*Job, error) {
+	var id = c.Param("id")
+	job, err := s.config.Store.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.Topic != c.Param("topic") {
+		return nil, c.Error(http.StatusNotFound,
+			fmt.Sprintf("job %s not found", id))
+	}
+	return job, nil
+}
+
+// GetJob отдает состояние задачи рассылки.
+func (s *Service) GetJob(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	job, err := s.job(c)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"job": job})
+}
+
+// CancelJob останавливает выполнение задачи рассылки.
+func (s *Service) CancelJob(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	job, err := s.job(c)
+	if err != nil {
+		return err
+	}
+	if !s.jobs.Cancel(job.ID) {
+		return c.Error(http.StatusConflict,
+			fmt.Sprintf("job %s is not running", job.ID))
+	}
+	job.Status = JobCancelled
+	return c.Write(rest.JSON{"job": job})
+}
+
+// ResumeJob продолжает выполнение остановленной или завершившейся с ошибкой
+// задачи рассылки с последней обработанной страницы.
+func (s *Service) ResumeJob(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	job, err := s.job(c)
+	if err != nil {
+		return err
+	}
+	if job.Status == JobCompleted || s.jobs.IsRunning(job.ID) {
+		return c.Error(http.StatusConflict,
+			fmt.Sprintf("job %s is %s", job.ID, job.Status))
+	}
+	if err := s.jobs.Start(job); err != nil {
+		return err
+	}
+	c.SetStatus(http.StatusAccepted)
+	return c.Write(rest.JSON{"job": job})
+}
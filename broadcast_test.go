@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+func TestJobRunnerCancel(t *testing.T) {
+	var r = newJobRunner(nil)
+	var stop = make(chan struct{})
+	r.running["job"] = stop
+	if !r.Cancel("job") || !r.Cancel("job") {
+		t.Fatal("cancel running job")
+	}
+	select {
+	case <-stop:
+	default:
+		t.Fatal("job not stopped")
+	}
+	// задача остается выполняющейся, пока не завершится ее обработчик
+	if !r.IsRunning("job") {
+		t.Fatal("cancelled job removed before its runner exited")
+	}
+	if err := r.Start(&Job{ID: "job"}); err != ErrJobRunning {
+		t.Fatalf("start cancelled job: %v", err)
+	}
+	// завершение прежнего обработчика не затрагивает новый запуск задачи
+	var next = make(chan struct{})
+	r.running["job"] = next
+	r.done("job", stop)
+	if !r.IsRunning("job") {
+		t.Fatal("stale runner removed new job")
+	}
+	r.done("job", next)
+	if r.IsRunning("job") || r.Cancel("job") {
+		t.Fatal("job still running")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Broadcast = &BroadcastConfig{PageSize: 2}
+	})
+	var tokens = []string{"AAAA", "BBBB", "CCCC", "DDDD", "EEEE", "FFFF"}
+	ts.addTokens("dmitrys", false, tokens[:3]...)
+	ts.addTokens("test", false, tokens[3:]...)
+	var path = "/apns/" + testTopic + "/broadcast"
+	ts.expect(http.StatusNotFound, "POST", path+"?sandbox", testPayload)
+	ts.expect(http.StatusBadRequest, "POST", path, map[string]interface{}{
+		"template": "welcome",
+	})
+	// job возвращает состояние задачи рассылки
+	job := func(resp *testResponse) *Job {
+		var result struct {
+			Job *Job `json:"job"`
+		}
+		resp.Decode(t, &result)
+		return result.Job
+	}
+	// ответ на CCCC задерживается, пока задача не будет остановлена
+	var block = make(chan struct{})
+	ts.apns.Respond("CCCC", mockapns.Response{Wait: block})
+	var request = map[string]interface{}{
+		"payload": testPayload["payload"],
+		"rate":    100,
+		"workers": 1,
+	}
+	started := job(ts.expect(http.StatusAccepted, "POST", path, request))
+	if started.Status != JobRunning || started.Total != len(tokens) ||
+		started.Rate != 100 || started.PageSize != 2 {
+		t.Fatalf("started: %+v", started)
+	}
+	path += "/" + started.ID
+	ts.waitRequests(3)
+	// остановленная задача не запускается повторно, пока отправка не прервана
+	if job := job(ts.expect(http.StatusOK, "DELETE", path, nil)); job.Status != JobCancelled {
+		t.Errorf("cancelled: %+v", job)
+	}
+	ts.expect(http.StatusConflict, "POST", path, nil)
+	close(block)
+	ts.waitJobs()
+	paused := job(ts.expect(http.StatusOK, "GET", path, nil))
+	if paused.Status != JobCancelled || paused.Sent != 3 || paused.Failed != 0 ||
+		paused.Cursor != "CCCC" || len(paused.Done) != 0 {
+		t.Fatalf("paused: %+v", paused)
+	}
+	ts.expect(http.StatusConflict, "DELETE", path, nil)
+	// продолжение отправляет только оставшиеся токены
+	ts.expect(http.StatusAccepted, "POST", path, nil)
+	ts.waitJobs()
+	completed := job(ts.expect(http.StatusOK, "GET", path, nil))
+	if completed.Status != JobCompleted || completed.Sent != len(tokens) ||
+		completed.Failed != 0 || completed.Cursor != tokens[len(tokens)-1] {
+		t.Fatalf("completed: %+v", completed)
+	}
+	ts.expect(http.StatusConflict, "POST", path, nil)
+	var received = make(map[string]int)
+	for _, req := range ts.apns.Requests() {
+		received[req.Token]++
+	}
+	if len(received) != len(tokens) {
+		t.Errorf("received: %v", received)
+	}
+	for _, token := range tokens {
+		if received[token] != 1 {
+			t.Errorf("%s: %d notifications received", token, received[token])
+		}
+	}
+	var list struct {
+		Jobs []*Job `json:"jobs"`
+	}
+	ts.expect(http.StatusOK, "GET", "/apns/"+testTopic+"/broadcast", nil).Decode(t, &list)
+	if len(list.Jobs) != 1 || list.Jobs[0].ID != started.ID {
+		t.Errorf("jobs: %+v", list.Jobs)
+	}
+}
+
+func TestBroadcastThrottled(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Throttle = &ThrottleConfig{Window: Duration(time.Minute)}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.addTokens("test", false, "CCCC")
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		testPayload)
+	// уведомления на токены, получившие уведомление только что, откладываются
+	var result struct {
+		Job *Job `json:"job"`
+	}
+	ts.expect(http.StatusAccepted, "POST", "/apns/"+testTopic+"/broadcast",
+		testPayload).Decode(t, &result)
+	ts.waitJobs()
+	ts.expect(http.StatusOK, "GET", "/apns/"+testTopic+"/broadcast/"+result.Job.ID,
+		nil).Decode(t, &result)
+	if job := result.Job; job.Status != JobCompleted || job.Sent != 1 ||
+		job.Throttled != 2 || job.Failed != 0 {
+		t.Errorf("job: %+v", job)
+	}
+}
+
+func TestBroadcastFailed(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Broadcast = &BroadcastConfig{PageSize: 2}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB", "CCCC", "DDDD")
+	// ошибка APNS, не связанная с токеном, прерывает рассылку
+	ts.apns.Respond("BBBB", mockapns.Response{
+		Status: http.StatusInternalServerError,
+		Reason: "InternalServerError",
+	})
+	var result struct {
+		Job *Job `json:"job"`
+	}
+	var path = "/apns/" + testTopic + "/broadcast"
+	ts.expect(http.StatusAccepted, "POST", path, map[string]interface{}{
+		"payload": testPayload["payload"],
+		"workers": 1,
+	}).Decode(t, &result)
+	path += "/" + result.Job.ID
+	ts.waitJobs()
+	ts.expect(http.StatusOK, "GET", path, nil).Decode(t, &result)
+	if job := result.Job; job.Status != JobFailed || job.Sent != 1 ||
+		job.Failed != 1 || job.Cursor != "BBBB" {
+		t.Fatalf("failed: %+v", job)
+	}
+	if n := len(ts.apns.Requests()); n != 2 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// продолжение начинается с токена, следующего за ошибкой
+	ts.apns.Respond("BBBB")
+	ts.expect(http.StatusAccepted, "POST", path, nil)
+	ts.waitJobs()
+	result.Job = nil
+	ts.expect(http.StatusOK, "GET", path, nil).Decode(t, &result)
+	if job := result.Job; job.Status != JobCompleted || job.Sent != 3 ||
+		job.Failed != 1 || job.Error != "" {
+		t.Errorf("completed: %+v", job)
+	}
+	if n := len(ts.apns.Requests()); n != 4 {
+		t.Errorf("apns requests: %d", n)
+	}
+}
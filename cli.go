@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands содержит подкоманды приложения. Подкоманды, кроме serve и
+// mock-apns, работают напрямую с файлами конфигурации и хранилища, поэтому
+// хранилище не должно быть открыто запущенным сервисом.
+var commands = map[string]func(args []string) error{
+	"serve":     runServe,
+	"user":      runUser,
+	"admin":     runAdmin,
+	"provider":  runProvider,
+	"token":     runToken,
+	"push":      runPush,
+	"stats":     runStats,
+	"config":    runConfig,
+	"mock-apns": runMockAPNS,
+}
+
+// stdout задает вывод результатов подкоманд.
+var stdout io.Writer = os.Stdout
+
+// usage выводит описание подкоманд.
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %[1]s [command] [-config file] [arguments]
+
+Commands:
+  serve [-address addr]                     start the service (default)
+  user list                                 list users
+  user add|passwd <login> <password>        add a user or change the password
+  user remove <login>                       remove a user
+  admin set [<login> <password>]            set or clear the administrator
+  provider set -team id -key id -p8 file    set the APNs provider key
+  token list -topic t [-user u]             list device tokens
+  token add -topic t -user u <token>        register a device token
+  token remove -topic t <token>             remove a device token
+  token find <token>                        find a device token in all topics
+  push -topic t -user u -payload file       send a notification to a user
+  stats                                     show tokens and usage
+  config check                              check the configuration
+  mock-apns [flags]                         start a local APNs mock server
+
+Use -sandbox with token and push commands for the development environment.
+`, appName)
+}
+
+// parseArgs разбирает флаги, которые могут следовать и после аргументов, и
+// возвращает список аргументов.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var list []string
+	for {
+		flags.Parse(args)
+		if args = flags.Args(); len(args) == 0 {
+			return list
+		}
+		list = append(list, args[0])
+		args = args[1:]
+	}
+}
+
+// commandFlags возвращает флаги подкоманды с флагом -config.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	var flags = flag.NewFlagSet(name, flag.ExitOnError)
+	filename := flags.String("config", config, "config `filename`")
+	return flags, filename
+}
+
+// errUsage возвращает ошибку неверного вызова подкоманды.
+func errUsage(format string) error {
+	return fmt.Errorf("usage: %s %s", appName, format)
+}
+
+// withConfig загружает конфигурацию, выполняет с ней функцию и закрывает.
+func withConfig(filename string, fn func(*Config) error) error {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		return err
+	}
+	defer config.Close()
+	return fn(config)
+}
+
+// runUser управляет пользователями в конфигурации.
+func runUser(args []string) error {
+	flags, filename := commandFlags("user")
+	args = parseArgs(flags, args)
+	if len(args) == 0 {
+		return errUsage("user list|add|passwd|remove")
+	}
+	return withConfig(*filename, func(config *Config) error {
+		switch action := args[0]; {
+		case action == "list" && len(args) == 1:
+			for _, login := range config.UsersList() {
+				fmt.Fprintln(stdout, login)
+			}
+			return nil
+		case (action == "add" || action == "passwd") && len(args) == 3:
+			if args[1] == "" {
+				return errors.New("empty login")
+			}
+			if action == "passwd" && !config.IsUser(args[1]) {
+				return fmt.Errorf("user %s not registered", args[1])
+			}
+			config.AddUser(args[1], args[2])
+		case action == "remove" && len(args) == 2:
+			if !config.RemoveUser(args[1]) {
+				return fmt.Errorf("user %s not registered", args[1])
+			}
+		default:
+			return errUsage("user list|add|passwd|remove")
+		}
+		return config.Save()
+	})
+}
+
+// runAdmin задает авторизацию администратора в конфигурации.
+func runAdmin(args []string) error {
+	flags, filename := commandFlags("admin")
+	args = parseArgs(flags, args)
+	if len(args) == 0 || args[0] != "set" || (len(args) != 1 && len(args) != 3) {
+		return errUsage("admin set [<login> <password>]")
+	}
+	return withConfig(*filename, func(config *Config) error {
+		if len(args) == 3 {
+			config.SetAdmin(args[1], args[2])
+		} else {
+			config.SetAdmin("", "")
+		}
+		return config.Save()
+	})
+}
+
+// runProvider задает ключ провайдера APNS в конфигурации.
+func runProvider(args []string) error {
+	flags, filename := commandFlags("provider")
+	var (
+		teamID = flags.String("team", "", "10 character team `id`")
+		keyID  = flags.String("key", "", "10 character key `id`")
+		p8     = flags.String("p8", "", "private key `file` (.p8)")
+	)
+	args = parseArgs(flags, args)
+	if len(args) != 1 || args[0] != "set" || *p8 == "" {
+		return errUsage("provider set -team id -key id -p8 file")
+	}
+	data, err := ioutil.ReadFile(*p8)
+	if err != nil {
+		return err
+	}
+	provider, err := NewProviderToken(*teamID, *keyID, data)
+	if err != nil {
+		return err
+	}
+	return withConfig(*filename, func(config *Config) error {
+		config.mu.Lock()
+		config.Provider = provider
+		config.mu.Unlock()
+		return config.Save()
+	})
+}
+
+// runToken управляет токенами устройств в хранилище.
+func runToken(args []string) error {
+	flags, filename := commandFlags("token")
+	var (
+		topic   = flags.String("topic", "", "application `topic`")
+		user    = flags.String("user", "", "user `login`")
+		kind    = flags.String("kind", "", "token `kind`: device or voip")
+		sandbox = flags.Bool("sandbox", false, "development environment")
+	)
+	args = parseArgs(flags, args)
+	if len(args) == 0 {
+		return errUsage("token list|add|remove|find")
+	}
+	return withConfig(*filename, func(config *Config) error {
+		var store = config.Store
+		switch action := args[0]; {
+		case action == "list" && len(args) == 1 && *topic != "":
+			var list []*TokenInfo
+			if *user != "" {
+				tokens, err := store.GetUserTokens(*kind, *topic, *sandbox, *user)
+				if err != nil {
+					return err
+				}
+				for _, token := range tokens {
+					list = append(list, &TokenInfo{Token: token, User: *user})
+				}
+			} else {
+				var err error
+				if list, err = store.GetTopicTokens(*kind, *topic, *sandbox); err != nil {
+					return err
+				}
+			}
+			return writeTokens(list, false)
+		case action == "add" && len(args) == 2 && *topic != "" && *user != "":
+			return config.AddToken(*user, *topic, args[1], *kind, *sandbox)
+		case action == "remove" && len(args) == 2 && *topic != "":
+			return store.Remove(args[1], *topic, time.Time{}, *sandbox)
+		case action == "find" && len(args) == 2:
+			list, err := store.FindToken(args[1])
+			if err != nil {
+				return err
+			}
+			if len(list) == 0 {
+				return fmt.Errorf("token %s not found", args[1])
+			}
+			return writeTokens(list, true)
+		default:
+			return errUsage("token list|add|remove|find -topic t [-user u] [token]")
+		}
+	})
+}
+
+// writeTokens выводит список токенов в виде таблицы.
+func writeTokens(list []*TokenInfo, topics bool) error {
+	var w = tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, info := range list {
+		var columns = []string{info.Token, info.User}
+		if topics {
+			var topic = info.Topic
+			if info.Sandbox {
+				topic += " (sandbox)"
+			}
+			columns = append(columns, topic)
+		}
+		if !info.Added.IsZero() {
+			columns = append(columns, info.Added.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	return w.Flush()
+}
+
+// runPush отправляет уведомление на все устройства пользователя.
+func runPush(args []string) error {
+	flags, filename := commandFlags("push")
+	var (
+		topic   = flags.String("topic", "", "application `topic`")
+		user    = flags.String("user", "", "user `login`")
+		payload = flags.String("payload", "", "JSON `file` with the notification payload")
+		sandbox = flags.Bool("sandbox", false, "development environment")
+	)
+	if args = parseArgs(flags, args); len(args) != 0 ||
+		*topic == "" || *user == "" || *payload == "" {
+		return errUsage("push -topic t -user u -payload file")
+	}
+	data, err := ioutil.ReadFile(*payload)
+	if err != nil {
+		return err
+	}
+	var notification = Notification{Topic: *topic, Sandbox: *sandbox}
+	if err := json.Unmarshal(data, &notification.Payload); err != nil {
+		return err
+	}
+	if err := notification.Validate(); err != nil {
+		return err
+	}
+	return withConfig(*filename, func(config *Config) error {
+		if config.Provider == nil {
+			return errors.New("provider key not set")
+		}
+		tokens, err := config.Store.GetUserTopicTokens(*topic, *sandbox, *user)
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			return fmt.Errorf("tokens for user %s not registered", *user)
+		}
+		sent, err := config.Push(notification, tokens)
+		var enc = json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"sent": sent}); err != nil {
+			return err
+		}
+		return err
+	})
+}
+
+// runStats выводит количество токенов по темам, пользователей и
+// использование квот за текущий месяц.
+func runStats(args []string) error {
+	flags, filename := commandFlags("stats")
+	if args = parseArgs(flags, args); len(args) != 0 {
+		return errUsage("stats")
+	}
+	return withConfig(*filename, func(config *Config) error {
+		topics, err := config.Store.GetTopicsStats()
+		if err != nil {
+			return err
+		}
+		var w = tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TOPIC\tTOKENS\tUSERS")
+		for _, stats := range topics {
+			var topic = stats.Topic
+			if stats.Sandbox {
+				topic += " (sandbox)"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\n", topic, stats.Tokens, stats.Users)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		scheduled, err := config.Store.CountScheduled()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "\nusers: %d\nscheduled: %d\n",
+			len(config.UsersList()), scheduled)
+		var month = usageMonth(time.Now())
+		usage, err := config.Store.GetUsage(month)
+		if err != nil {
+			return err
+		}
+		if len(usage) > 0 {
+			var keys = make([]string, 0, len(usage))
+			for key := range usage {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(stdout, "\nusage %s:\n", month)
+			for _, key := range keys {
+				fmt.Fprintf(stdout, "  %s: %d\n", key, usage[key])
+			}
+		}
+		return nil
+	})
+}
+
+// runConfig проверяет конфигурацию.
+func runConfig(args []string) error {
+	flags, filename := commandFlags("config")
+	if args = parseArgs(flags, args); len(args) != 1 || args[0] != "check" {
+		return errUsage("config check")
+	}
+	return withConfig(*filename, func(config *Config) error {
+		problems := config.Check()
+		for _, problem := range problems {
+			fmt.Fprintln(stdout, problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d config problems", len(problems))
+		}
+		fmt.Fprintln(stdout, "config ok")
+		return nil
+	})
+}
+
+// Check проверяет загруженную конфигурацию и возвращает список найденных
+// проблем.
+func (c *Config) Check() (problems []string) {
+	if c.Provider == nil {
+		problems = append(problems, "apnsToken: provider key not set")
+	}
+	if err := c.Store.Check(); err != nil {
+		problems = append(problems, "deviceTokens: "+err.Error())
+	}
+	if c.TLS != nil {
+		if _, _, err := c.TLS.Config(); err != nil {
+			problems = append(problems, "tls: "+err.Error())
+		}
+	}
+	for login := range c.Certificates {
+		if user := c.Certificates[login]; user != "admin" && !c.IsUser(user) {
+			problems = append(problems, fmt.Sprintf(
+				"certificates: %s mapped to unknown user %s", login, user))
+		}
+	}
+	for i, webhook := range c.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || !u.IsAbs() {
+			problems = append(problems, fmt.Sprintf(
+				"webhooks[%d]: bad url %q", i, webhook.URL))
+		}
+	}
+	for topic, quiet := range c.QuietHours {
+		if quiet == nil {
+			continue
+		}
+		if err := validTimeZone(quiet.TimeZone); err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"quietHours %s: %v", topic, err))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
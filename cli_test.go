@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var filename = filepath.Join(dir, "pusher.json")
+	data, err := json.Marshal(map[string]interface{}{
+		"deviceTokens": filepath.Join(dir, "tokens.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { stdout = os.Stdout }()
+	// run выполняет подкоманду с файлом конфигурации и возвращает ее вывод
+	run := func(name string, args ...string) (string, error) {
+		t.Helper()
+		var output = new(bytes.Buffer)
+		stdout = output
+		err := commands[name](append(args, "-config", filename))
+		return output.String(), err
+	}
+	// пользователи сохраняются в конфигурации
+	if _, err := run("user", "add", "dmitrys", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("user", "passwd", "test", "password"); err == nil {
+		t.Error("changed password of unknown user")
+	}
+	if out, err := run("user", "list"); err != nil || out != "dmitrys\n" {
+		t.Errorf("users: %q, %v", out, err)
+	}
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsUser("dmitrys") {
+		t.Error("user not saved")
+	}
+	config.Close()
+	// токены ищутся во всех темах
+	if _, err := run("token", "add", "-topic", testTopic, "-user", "dmitrys", "AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("token", "add", "-sandbox", "-topic", "com.example", "-user", "dmitrys", "AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run("token", "find", "AAAA")
+	if err != nil || !strings.Contains(out, testTopic) ||
+		!strings.Contains(out, "com.example (sandbox)") {
+		t.Errorf("find: %q, %v", out, err)
+	}
+	if _, err := run("token", "remove", "-topic", testTopic, "AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("token", "list", "-topic", testTopic); err != nil || out != "" {
+		t.Errorf("tokens after remove: %q, %v", out, err)
+	}
+	// токены VoIP выводятся для всей темы
+	if _, err := run("token", "add", "-topic", testTopic, "-user", "dmitrys",
+		"-kind", "voip", "BBBB"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("token", "list", "-topic", testTopic, "-kind", "voip"); err != nil ||
+		!strings.Contains(out, "BBBB") || !strings.Contains(out, "dmitrys") {
+		t.Errorf("voip tokens: %q, %v", out, err)
+	}
+	if out, err := run("token", "list", "-topic", testTopic); err != nil || out != "" {
+		t.Errorf("device tokens: %q, %v", out, err)
+	}
+	if out, err := run("stats"); err != nil || !strings.Contains(out, "users: 1") {
+		t.Errorf("stats: %q, %v", out, err)
+	}
+	// без ключа провайдера конфигурация не проходит проверку
+	if out, err := run("config", "check"); err == nil || !strings.Contains(out, "apnsToken") {
+		t.Errorf("config check: %q, %v", out, err)
+	}
+	if _, err := run("user", "remove", "dmitrys"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("user", "list"); err != nil || out != "" {
+		t.Errorf("users after remove: %q, %v", out, err)
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/mdigger/log"
+	"golang.org/x/net/http2"
 )
 
 // Password описывает хеш от пароля для хранения.
@@ -28,6 +34,29 @@ func (p Password) Equal(password string) bool {
 	return bytes.Equal(p, passwd)
 }
 
+// Duration описывает интервал времени, который задается в конфигурации
+// строкой в формате time.ParseDuration, например "24h".
+type Duration time.Duration
+
+// MarshalJSON возвращает интервал в виде строки JSON.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON разбирает интервал из строки JSON.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
 // Admin описывает данные для авторизации администратора.
 type Admin struct {
 	Login    string   `json:"login"`
@@ -37,13 +66,33 @@ type Admin struct {
 // Users содержит список пользователей для авторизации.
 type Users map[string]Password
 
+// Certificates задает соответствие имен из клиентских сертификатов логинам
+// пользователей или администратора.
+type Certificates map[string]string
+
 // Config описывает конфигурацию сервиса.
 type Config struct {
-	Admin    *Admin         `json:"admin,omitempty"`
-	Users    Users          `json:"users,omitempty"`
-	Provider *ProviderToken `json:"apnsToken,omitempty"`
-	Store    *Store         `json:"deviceTokens,omitempty"`
-	mu       sync.RWMutex
+	Address      string             `json:"address,omitempty"`
+	TLS          *TLSConfig         `json:"tls,omitempty"`
+	Admin        *Admin             `json:"admin,omitempty"`
+	Users        Users              `json:"users,omitempty"`
+	Certificates Certificates       `json:"certificates,omitempty"`
+	Provider     *ProviderToken     `json:"apnsToken,omitempty"`
+	Store        *Store             `json:"deviceTokens,omitempty"`
+	APNS         *APNSConfig        `json:"apns,omitempty"`
+	Broadcast    *BroadcastConfig   `json:"broadcast,omitempty"`
+	Webhooks     []*Webhook         `json:"webhooks,omitempty"`
+	Idempotency  *IdempotencyConfig `json:"idempotency,omitempty"`
+	Limits       *LimitsConfig      `json:"limits,omitempty"`
+	Throttle     *ThrottleConfig    `json:"throttle,omitempty"`
+	QuietHours   QuietHoursConfig   `json:"quietHours,omitempty"`
+	History      HistoryConfig      `json:"history,omitempty"`
+	hooks        *webhookSender     // доставка событий подписчикам
+	throttle     *tokenThrottle     // отложенные уведомления на токены
+	scheduler    *pushScheduler     // отправка уведомлений по расписанию
+	client       *http.Client       // клиент APNS с сертификатами из APNS.CAFile
+	filename     string             // файл, из которого загружена конфигурация
+	mu           sync.RWMutex
 }
 
 // LoadConfig загружает конфигурацию сервиса из файла.
@@ -52,12 +101,20 @@ func LoadConfig(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	var service = new(Config)
+	var service = &Config{filename: filename}
 	err = json.NewDecoder(file).Decode(service)
 	file.Close()
 	if err != nil {
 		return nil, err
 	}
+	// настраиваем доверенные сертификаты для сервера APNS
+	if service.APNS != nil && service.APNS.CAFile != "" {
+		service.client, err = newAPNSClient(service.APNS.CAFile)
+		if err != nil {
+			service.Close()
+			return nil, err
+		}
+	}
 	// инициализируем хранилище, если оно не указано в конфигурации
 	if service.Store == nil {
 		store, err := OpenStore("tokens.db")
@@ -69,21 +126,37 @@ func LoadConfig(filename string) (*Config, error) {
 	return service, nil
 }
 
-// Save сохраняет конфигурацию в файл.
+// Save сохраняет конфигурацию в файл, из которого она была загружена. Если
+// конфигурация загружена не из файла, то она не сохраняется.
 func (c *Config) Save() error {
-	file, err := os.Create(config)
+	if c.filename == "" {
+		return nil
+	}
+	c.mu.RLock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	c.mu.RUnlock()
 	if err != nil {
 		return err
 	}
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "  ")
-	err = enc.Encode(c)
-	file.Close()
-	return err
+	// записываем во временный файл, чтобы не потерять конфигурацию при сбое
+	var tmp = c.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
 }
 
 // Close закрывает сервис.
 func (c *Config) Close() error {
+	if c.scheduler != nil {
+		c.scheduler.Close()
+	}
+	if c.throttle != nil {
+		c.throttle.Close()
+	}
+	if c.hooks != nil {
+		c.hooks.Close()
+	}
 	if c.Store != nil {
 		return c.Store.Close()
 	}
@@ -157,6 +230,39 @@ func (c *Config) UserAuthorization(login, password string) bool {
 	return exist && passwd.Equal(password)
 }
 
+// CertificateLogin возвращает логин, сопоставленный с именем субъекта или
+// одним из альтернативных имен (SAN) клиентского сертификата. Если
+// сопоставление не найдено, то возвращается пустая строка.
+func (c *Config) CertificateLogin(cert *x509.Certificate) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.Certificates) == 0 {
+		return ""
+	}
+	for _, name := range certificateNames(cert) {
+		if login, ok := c.Certificates[name]; ok {
+			return login
+		}
+	}
+	return ""
+}
+
+// IsAdmin возвращает true, если логин совпадает с логином администратора.
+func (c *Config) IsAdmin(login string) bool {
+	c.mu.RLock()
+	var result = c.Admin != nil && c.Admin.Login != "" && c.Admin.Login == login
+	c.mu.RUnlock()
+	return result
+}
+
+// IsUser возвращает true, если пользователь с таким логином зарегистрирован.
+func (c *Config) IsUser(login string) bool {
+	c.mu.RLock()
+	_, exist := c.Users[login]
+	c.mu.RUnlock()
+	return exist
+}
+
 // AddUser добавляет нового пользователя для авторизации. Возвращает true, если
 // пользователь с таким логином уже был зарегистрирован и произошла замена
 // пароля для него. Если это новый пользователь, то возвращается false.
@@ -206,6 +312,57 @@ func (c *Config) UsersList() []string {
 	return list
 }
 
+// APNSConfig описывает адреса серверов APNS для рабочего окружения и
+// окружения разработки. Пустой адрес означает сервер Apple.
+type APNSConfig struct {
+	Production  string `json:"production,omitempty"`
+	Development string `json:"development,omitempty"`
+	CAFile      string `json:"caFile,omitempty"` // сертификаты CA серверов
+}
+
+// APNSHost возвращает адрес сервера APNS для указанного окружения.
+func (c *Config) APNSHost(sandbox bool) string {
+	var host string
+	if c.APNS != nil {
+		if sandbox {
+			host = c.APNS.Development
+		} else {
+			host = c.APNS.Production
+		}
+	}
+	if host == "" {
+		host = apnsHost(sandbox)
+	}
+	return host
+}
+
+// newAPNSClient возвращает клиент APNS, который доверяет корневым
+// сертификатам из файла в формате PEM вместо системных.
+func newAPNSClient(filename string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		Timeout: httpAPNSClient.Timeout,
+	}, nil
+}
+
+// apnsClient возвращает клиент для запросов к серверу APNS.
+func (c *Config) apnsClient() *http.Client {
+	if c.client != nil {
+		return c.client
+	}
+	return httpAPNSClient
+}
+
 // SetProviderToken устанавливает APNS токен для конфигурации.
 func (c *Config) SetProviderToken(teamID, keyID string, privateKeyData []byte) error {
 	log.WithFields(log.Fields{
@@ -223,15 +380,17 @@ func (c *Config) SetProviderToken(teamID, keyID string, privateKeyData []byte) e
 	return nil
 }
 
-// AddToken добавляет токен устройства пользователя в хранилище токенов.
-func (c *Config) AddToken(user, topic, token string, sandbox bool) error {
+// AddToken добавляет токен пользователя указанного вида (device или voip) в
+// хранилище токенов.
+func (c *Config) AddToken(user, topic, token, kind string, sandbox bool) error {
 	ctxlog := log.WithFields(log.Fields{
 		"user":    user,
 		"topic":   topic,
 		"token":   token,
+		"kind":    kind,
 		"sandbox": sandbox,
 	})
-	err := c.Store.Save(user, topic, token, sandbox)
+	err := c.Store.SaveToken(kind, user, topic, token, sandbox)
 	if err != nil {
 		ctxlog.WithError(err).Error("add token error")
 	} else {
@@ -264,40 +423,80 @@ func (c *Config) Push(notification Notification, tokens []string) (
 	status map[string]string, err error) {
 	status = make(map[string]string, len(tokens))
 	for _, token := range tokens {
-		ctxlog := log.WithFields(log.Fields{
-			"token": token,
-			"topic": notification.Topic,
+		status[token], err = c.pushToken(notification, token)
+		if err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// pushToken отправляет push-уведомление на один токен устройства и возвращает
+// статус отправки. Если токен оказался недействительным, то он удаляется из
+// хранилища. Если включено ограничение отправки на токен, то уведомления сверх
+// ограничения или отклоненные APNS из-за частой отправки откладываются и
+// возвращается статус throttled. Ошибка возвращается только в том случае, если
+// дальнейшая отправка уведомлений невозможна.
+func (c *Config) pushToken(notification Notification, token string) (
+	status string, err error) {
+	ctxlog := log.WithFields(log.Fields{
+		"token": token,
+		"topic": notification.Topic,
+	})
+	notification.Token = token
+	notification.Host = c.APNSHost(notification.Sandbox)
+	if c.throttle != nil && !c.throttle.Allow(notification) {
+		ctxlog.Debug("push throttled")
+		return StatusThrottled, nil
+	}
+	var event = &pushEvent{
+		Topic:   notification.Topic,
+		Token:   token,
+		Sandbox: notification.Sandbox,
+	}
+	event.ID, err = c.Provider.Push(c.apnsClient(), notification)
+	if err == nil {
+		ctxlog.Debug("push sent")
+		c.emit(EventPushDelivered, event.Topic, event)
+		return "OK", nil
+	}
+	event.Error = err.Error()
+	if apnserr, ok := err.(*Error); ok {
+		ctxlog = ctxlog.WithError(err).WithFields(log.Fields{
+			"reason":  apnserr.Reason,
+			"status":  apnserr.Status,
+			"isToken": apnserr.IsToken(),
 		})
-		notification.Token = token
-		_, err = c.Provider.Push(notification)
-		if err == nil {
-			ctxlog.Debug("push sent")
-			status[token] = "OK"
-			continue
+		status = apnserr.Error()
+		event.Status = apnserr.Status
+		event.Reason = apnserr.Reason
+		event.Timestamp = apnserr.Timestamp
+		c.emit(EventPushFailed, event.Topic, event)
+		if apnserr.IsToken() {
+			ctxlog.Warning("token error")
+			// удаляем токен в случае ошибки связанной с ним
+			err = c.RemoveToken(token,
+				notification.Topic,
+				apnserr.Time(),
+				notification.Sandbox)
+			if err == nil {
+				c.emit(EventTokenRemoved, event.Topic, event)
+				return status, nil // переходим к следующему токену
+			}
 		}
-		if apnserr, ok := err.(*Error); ok {
-			ctxlog = ctxlog.WithError(err).WithFields(log.Fields{
-				"reason":  apnserr.Reason,
-				"status":  apnserr.Status,
-				"isToken": apnserr.IsToken(),
-			})
-			status[token] = apnserr.Error()
-			if apnserr.IsToken() {
-				ctxlog.Warning("token error")
-				// удаляем токен в случае ошибки связанной с ним
-				err = c.RemoveToken(token,
-					notification.Topic,
-					apnserr.Time(),
-					notification.Sandbox)
-				if err == nil {
-					continue // переходим к следующему токену
-				}
+		if apnserr.IsTooManyRequests() {
+			ctxlog.Warning("too many requests")
+			// отклонено только для этого токена: откладываем или пропускаем
+			if c.throttle != nil {
+				c.throttle.Hold(notification)
+				return StatusThrottled, nil
 			}
-		} else {
-			status[token] = err.Error()
+			return status, nil
 		}
-		ctxlog.WithError(err).Error("push error")
-		return status, err
+	} else {
+		status = err.Error()
+		c.emit(EventPushFailed, event.Topic, event)
 	}
-	return status, nil
+	ctxlog.WithError(err).Error("push error")
+	return status, err
 }
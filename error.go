@@ -55,6 +55,56 @@ func (e *Error) IsToken() bool {
 	}
 }
 
+// IsProviderToken returns true if the provider token was rejected as expired
+// or invalid.
+func (e *Error) IsProviderToken() bool {
+	return e.Reason == "ExpiredProviderToken" ||
+		e.Reason == "InvalidProviderToken"
+}
+
+// IsTooManyRequests returns true if too many notifications were sent to the
+// same device token in a short time.
+func (e *Error) IsTooManyRequests() bool {
+	return e.Reason == "TooManyRequests"
+}
+
+// HTTPStatus returns the HTTP status code of the service response for a push
+// request that failed with this error.
+func (e *Error) HTTPStatus() int {
+	switch e.Reason {
+	case "BadCollapseId",
+		"BadDeviceToken",
+		"BadExpirationDate",
+		"BadMessageId",
+		"BadPriority",
+		"BadTopic",
+		"DeviceTokenNotForTopic",
+		"DuplicateHeaders",
+		"MissingDeviceToken",
+		"MissingTopic",
+		"PayloadEmpty",
+		"BadPath":
+		return http.StatusBadRequest
+	case "TopicDisallowed":
+		return http.StatusForbidden
+	case "Unregistered":
+		return http.StatusGone
+	case "PayloadTooLarge":
+		return http.StatusRequestEntityTooLarge
+	case "TooManyRequests",
+		"TooManyProviderTokenUpdates":
+		return http.StatusTooManyRequests
+	case "IdleTimeout",
+		"InternalServerError",
+		"ServiceUnavailable",
+		"Shutdown":
+		return http.StatusServiceUnavailable
+	default:
+		// rejected provider credentials and other problems of the service itself
+		return http.StatusBadGateway
+	}
+}
+
 var reasons = map[string]string{
 	"BadCollapseId":               "The collapse identifier exceeds the maximum allowed size.",
 	"BadDeviceToken":              "The specified device token was bad. Verify that the request contains a valid token and that the token matches the environment.",
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mdigger/rest"
+)
+
+// Health отвечает на проверку работоспособности сервиса (liveness). Если
+// сервис может обработать запрос, то он считается живым.
+func (s *Service) Health(c *rest.Context) error {
+	return c.Write(rest.JSON{"status": "ok"})
+}
+
+// Ready отвечает на проверку готовности сервиса к обработке запросов
+// (readiness). Проверяется доступность хранилища токенов и возможность
+// сформировать токен авторизации APNS. Если в запросе указан параметр apns, то
+// дополнительно проверяется HTTP/2 соединение с сервером APNS (с учетом
+// параметра sandbox).
+func (s *Service) Ready(c *rest.Context) error {
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	var (
+		checks = make(map[string]string, 3) // результаты проверок
+		ready  = true                       // флаг готовности
+	)
+	// сохраняет результат проверки
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+	// проверяем, что хранилище токенов открывается на чтение
+	check("store", s.config.Store.Check())
+	// проверяем, что ключ провайдера задан и им можно подписать токен
+	s.config.mu.RLock()
+	provider := s.config.Provider
+	s.config.mu.RUnlock()
+	_, err := provider.JWT()
+	check("provider", err)
+	// по запросу проверяем соединение с сервером APNS
+	if len(query["apns"]) != 0 {
+		check("apns", checkAPNSConnection(s.config.apnsClient(),
+			s.config.APNSHost(sandbox)))
+	}
+	var status = "ok"
+	if !ready {
+		status = "fail"
+		c.SetStatus(http.StatusServiceUnavailable)
+	}
+	return c.Write(rest.JSON{"status": status, "checks": checks})
+}
+
+// checkAPNSConnection проверяет, что с сервером APNS устанавливается HTTP/2
+// соединение. Любой ответ сервера, полученный по протоколу HTTP/2, считается
+// успешным.
+func checkAPNSConnection(client *http.Client, host string) error {
+	req, err := http.NewRequest(http.MethodGet, host, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("user-agent", agent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("unexpected protocol %s", resp.Proto)
+	}
+	return nil
+}
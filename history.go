@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// History описывает хранение истории отправленных уведомлений для темы.
+type History struct {
+	MaxAge   Duration `json:"maxAge,omitempty"`   // по умолчанию 30 дней
+	MaxCount int      `json:"maxCount,omitempty"` // на пользователя, по умолчанию 100
+}
+
+// Ограничения хранения истории уведомлений по умолчанию.
+const (
+	defaultHistoryMaxAge   = 30 * 24 * time.Hour
+	defaultHistoryMaxCount = 100
+)
+
+// maxAge возвращает время хранения уведомления в истории.
+func (h *History) maxAge() time.Duration {
+	if h.MaxAge > 0 {
+		return time.Duration(h.MaxAge)
+	}
+	return defaultHistoryMaxAge
+}
+
+// maxCount возвращает количество хранимых уведомлений пользователя.
+func (h *History) maxCount() int {
+	if h.MaxCount > 0 {
+		return h.MaxCount
+	}
+	return defaultHistoryMaxCount
+}
+
+// HistoryConfig задает темы, для которых сохраняется история уведомлений.
+// Ключ "*" включает историю для всех тем, для которых она не задана явно.
+type HistoryConfig map[string]*History
+
+// Topic возвращает настройки истории для темы или nil, если история для нее
+// не сохраняется.
+func (h HistoryConfig) Topic(topic string) *History {
+	if history, ok := h[topic]; ok {
+		return history
+	}
+	return h["*"]
+}
+
+// HistoryItem описывает уведомление в истории пользователя.
+type HistoryItem struct {
+	ID         string            `json:"id"`
+	Created    time.Time         `json:"created"`
+	PushType   string            `json:"pushType,omitempty"`
+	CollapseID string            `json:"collapseId,omitempty"`
+	Payload    json.RawMessage   `json:"payload"`
+	Devices    map[string]string `json:"devices"` // статусы отправки по токенам
+	Read       bool              `json:"read"`
+}
+
+// historyRecorder собирает уведомления, отправленные по одному запросу,
+// в элементы истории их пользователей. Все элементы запроса сохраняются с
+// одним идентификатором, по которому обновляются статусы отложенной отправки.
+type historyRecorder struct {
+	store   *Store
+	topic   string
+	sandbox bool
+	history *History
+	id      string                  // идентификатор уведомления в истории
+	users   map[string]string       // пользователи токенов
+	items   map[string]*HistoryItem // уведомления пользователей
+}
+
+// newHistoryRecorder возвращает сборщик истории для токенов темы или nil,
+// если история для темы не сохраняется.
+func (c *Config) newHistoryRecorder(topic string, sandbox bool,
+	tokens []string) (*historyRecorder, error) {
+	history := c.History.Topic(topic)
+	if history == nil {
+		return nil, nil
+	}
+	users, err := c.Store.GetTokensUsers(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	id, err := c.Store.NextHistoryID(topic, sandbox)
+	if err != nil {
+		return nil, err
+	}
+	return &historyRecorder{
+		store:   c.Store,
+		topic:   topic,
+		sandbox: sandbox,
+		history: history,
+		id:      id,
+		users:   users,
+		items:   make(map[string]*HistoryItem),
+	}, nil
+}
+
+// ID возвращает идентификатор уведомления в истории или пустую строку, если
+// история не сохраняется.
+func (h *historyRecorder) ID() string {
+	if h == nil {
+		return ""
+	}
+	return h.id
+}
+
+// Add добавляет статусы отправки уведомления. Для пользователя сохраняется
+// содержимое первого уведомления, отправленного на его устройства.
+func (h *historyRecorder) Add(notification Notification, sent map[string]string) {
+	if h == nil {
+		return
+	}
+	for token, status := range sent {
+		user, ok := h.users[token]
+		if !ok {
+			continue
+		}
+		item := h.items[user]
+		if item == nil {
+			payload, err := notification.payload()
+			if err != nil {
+				continue
+			}
+			item = &HistoryItem{
+				ID:         h.id,
+				Created:    time.Now().UTC(),
+				PushType:   notification.PushType,
+				CollapseID: notification.CollapseID,
+				Payload:    payload,
+				Devices:    make(map[string]string),
+			}
+			h.items[user] = item
+		}
+		item.Devices[token] = status
+	}
+}
+
+// Save сохраняет собранные уведомления в истории пользователей.
+func (h *historyRecorder) Save() {
+	if h == nil {
+		return
+	}
+	for user, item := range h.items {
+		err := h.store.AddHistory(h.topic, h.sandbox, user, item,
+			h.history.maxAge(), h.history.maxCount())
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"topic": h.topic,
+				"user":  user,
+			}).Error("save history error")
+		}
+	}
+}
+
+// pushDeferred отправляет уведомление, отложенное до окончания тихих часов
+// или из-за частой отправки, и обновляет статус отправки на токен в истории
+// пользователя.
+func (c *Config) pushDeferred(notification Notification) (string, error) {
+	status, err := c.pushToken(notification, notification.Token)
+	// ошибка соединения не меняет статус: отправка повторяется или прервана
+	if _, ok := err.(*Error); notification.History == "" || err != nil && !ok {
+		return status, err
+	}
+	users, err2 := c.Store.GetTokensUsers(notification.Topic,
+		notification.Sandbox, notification.Token)
+	if user, ok := users[notification.Token]; ok && err2 == nil {
+		err2 = c.Store.SetHistoryStatus(notification.Topic, notification.Sandbox,
+			user, notification.History, notification.Token, status)
+	}
+	if err2 != nil {
+		log.WithError(err2).WithFields(log.Fields{
+			"topic": notification.Topic,
+			"token": notification.Token,
+		}).Error("update history error")
+	}
+	return status, err
+}
+
+// historyParams проверяет авторизацию пользователя и возвращает тему,
+// пользователя, флаг sandbox и настройки истории запроса.
+func (s *Service) historyParams(c *rest.Context) (topic, user string,
+	sandbox bool, history *History, err error) {
+	if err = s.UserAuth(c); err != nil {
+		return
+	}
+	user = c.Param("login")  // логин пользователя
+	topic = c.Param("topic") // тема
+	if user == "" || topic == "" {
+		err = rest.ErrNotFound
+		return
+	}
+	sandbox = len(c.Request.URL.Query()["sandbox"]) != 0 // флаг sandbox
+	if history = s.config.History.Topic(topic); history == nil {
+		err = c.Error(http.StatusNotFound,
+			fmt.Sprintf("history for topic %s is disabled", topic))
+	}
+	return
+}
+
+// GetHistory отдает уведомления из истории пользователя от новых к старым.
+// Параметр before задает идентификатор, с которого начинается страница, limit
+// — ее размер, а unread оставляет только непрочитанные уведомления.
+func (s *Service) GetHistory(c *rest.Context) error {
+	topic, user, sandbox, history, err := s.historyParams(c)
+	if err != nil {
+		return err
+	}
+	query := c.Request.URL.Query()
+	var limit = 20
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return c.Error(http.StatusBadRequest, "bad limit")
+		}
+	}
+	unread := len(query["unread"]) != 0
+	since := time.Now().Add(-history.maxAge())
+	items, err := s.config.Store.GetHistory(topic, sandbox, user,
+		query.Get("before"), limit+1, func(item *HistoryItem) bool {
+			return item.Created.After(since) && !(unread && item.Read)
+		})
+	if err != nil {
+		return err
+	}
+	var result = rest.JSON{"notifications": items}
+	if len(items) > limit {
+		result["notifications"] = items[:limit]
+		result["next"] = items[limit-1].ID
+	}
+	return c.Write(result)
+}
+
+// historyRead описывает запрос на отметку уведомлений прочитанными. Если
+// read не задан, то уведомления отмечаются прочитанными.
+type historyRead struct {
+	Read *bool `json:"read" form:"read"`
+}
+
+// value возвращает отметку о прочтении из запроса.
+func (r *historyRead) value() bool {
+	return r.Read == nil || *r.Read
+}
+
+// ReadHistory отмечает все уведомления истории пользователя прочитанными или
+// непрочитанными.
+func (s *Service) ReadHistory(c *rest.Context) error {
+	topic, user, sandbox, _, err := s.historyParams(c)
+	if err != nil {
+		return err
+	}
+	var request = new(historyRead)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	count, err := s.config.Store.MarkHistory(topic, sandbox, user, "",
+		request.value())
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"updated": count})
+}
+
+// ReadHistoryItem отмечает уведомление в истории пользователя прочитанным или
+// непрочитанным.
+func (s *Service) ReadHistoryItem(c *rest.Context) error {
+	topic, user, sandbox, _, err := s.historyParams(c)
+	if err != nil {
+		return err
+	}
+	var request = new(historyRead)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	id := c.Param("id")
+	count, err := s.config.Store.MarkHistory(topic, sandbox, user, id,
+		request.value())
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("notification %s not found", id))
+	}
+	return c.Write(rest.JSON{"updated": count})
+}
+
+// RemoveHistoryItem удаляет уведомление из истории пользователя.
+func (s *Service) RemoveHistoryItem(c *rest.Context) error {
+	topic, user, sandbox, _, err := s.historyParams(c)
+	if err != nil {
+		return err
+	}
+	id := c.Param("id")
+	exist, err := s.config.Store.RemoveHistory(topic, sandbox, user, id)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("notification %s not found", id))
+	}
+	return c.Write(rest.JSON{"removed": id})
+}
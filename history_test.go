@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.History = HistoryConfig{testTopic: {MaxCount: 3}}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.addTokens("test", false, "CCCC")
+	var path = "/apns/" + testTopic + "/users/dmitrys/notifications"
+	// история не ведется для других тем
+	ts.expect(http.StatusNotFound, "GET", "/apns/com.example/users/dmitrys/notifications", nil)
+	for _, alert := range []string{"one", "two", "three", "four"} {
+		ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/push",
+			map[string]interface{}{
+				"payload": map[string]interface{}{
+					"aps": map[string]interface{}{"alert": alert},
+				},
+				"users": []string{"dmitrys", "test"},
+			})
+	}
+	// history возвращает страницу истории пользователя
+	type page struct {
+		Notifications []*HistoryItem `json:"notifications"`
+		Next          string         `json:"next"`
+	}
+	history := func(query string) *page {
+		t.Helper()
+		var result = new(page)
+		ts.expect(http.StatusOK, "GET", path+query, nil).Decode(t, result)
+		return result
+	}
+	// хранятся только последние уведомления
+	first := history("?limit=2")
+	if len(first.Notifications) != 2 || first.Next == "" {
+		t.Fatalf("first page: %+v", first)
+	}
+	if item := first.Notifications[0]; string(item.Payload) != `{"aps":{"alert":"four"}}` ||
+		item.Devices["AAAA"] != "OK" || item.Devices["BBBB"] != "OK" ||
+		len(item.Devices) != 2 || item.Read {
+		t.Errorf("latest: %+v", item)
+	}
+	second := history("?limit=2&before=" + first.Next)
+	if len(second.Notifications) != 1 || second.Next != "" ||
+		string(second.Notifications[0].Payload) != `{"aps":{"alert":"two"}}` {
+		t.Errorf("second page: %+v", second)
+	}
+	// отметка о прочтении и удаление
+	id := first.Notifications[0].ID
+	ts.expect(http.StatusOK, "PUT", path+"/"+id, map[string]interface{}{})
+	if unread := history("?unread"); len(unread.Notifications) != 2 {
+		t.Errorf("unread: %+v", unread)
+	}
+	ts.expect(http.StatusOK, "PUT", path, map[string]interface{}{"read": true})
+	if unread := history("?unread"); len(unread.Notifications) != 0 {
+		t.Errorf("unread after read all: %+v", unread)
+	}
+	ts.expect(http.StatusOK, "DELETE", path+"/"+id, nil)
+	ts.expect(http.StatusNotFound, "DELETE", path+"/"+id, nil)
+	ts.expect(http.StatusNotFound, "PUT", path+"/"+id, map[string]interface{}{})
+	if all := history(""); len(all.Notifications) != 2 {
+		t.Errorf("after delete: %+v", all)
+	}
+	// история других пользователей не меняется
+	resp := ts.expect(http.StatusOK, "GET",
+		"/apns/"+testTopic+"/users/test/notifications?unread", nil)
+	var other = new(page)
+	resp.Decode(t, other)
+	if len(other.Notifications) != 3 {
+		t.Errorf("other user: %+v", other)
+	}
+}
+
+func TestHistoryDeferred(t *testing.T) {
+	const window = 200 * time.Millisecond
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.History = HistoryConfig{"*": {}}
+		config.Throttle = &ThrottleConfig{Window: Duration(window)}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	for _, status := range []string{"OK", StatusThrottled} {
+		resp := ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+			testPayload)
+		if sent := sent(t, resp); sent["AAAA"] != status {
+			t.Fatalf("sent: %v, want %s", sent, status)
+		}
+	}
+	// статус отложенного уведомления обновляется после его отправки
+	var result struct {
+		Notifications []*HistoryItem `json:"notifications"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		result.Notifications = nil
+		ts.expect(http.StatusOK, "GET", "/apns/"+testTopic+"/users/dmitrys/notifications",
+			nil).Decode(t, &result)
+		if len(result.Notifications) == 2 &&
+			result.Notifications[0].Devices["AAAA"] == "OK" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history: %+v", result.Notifications[0])
+		}
+		time.Sleep(window / 10)
+	}
+	if n := len(ts.apns.Requests()); n != 2 {
+		t.Errorf("apns requests: %d", n)
+	}
+}
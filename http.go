@@ -12,6 +12,9 @@ import (
 type Service struct {
 	mux    *rest.ServeMux // мультиплексор запросов
 	config *Config        // конфигурация сервиса
+	jobs   *jobRunner     // фоновые задачи рассылки
+	limits rateLimits     // ограничители частоты запросов
+	routes []string       // зарегистрированные обработчики: метод и путь
 }
 
 // NewService инициализирует новый сервис по конфигурации.
@@ -28,27 +31,127 @@ func NewService(config *Config) *Service {
 	var service = &Service{
 		mux:    mux,
 		config: config,
+		jobs:   newJobRunner(config),
 	}
 	// добавляем обработчики запросов администрирования
-	mux.Handle("GET", "/users", service.GetUsers)
-	mux.Handle("POST", "/users", service.AddUser)
-	mux.Handle("DELETE", "/users/:login", service.RemoveUser)
-	mux.Handle("PUT", "/users/:login", service.ChangeUser)
+	service.handle("GET", "/users", service.GetUsers)
+	service.handle("POST", "/users", service.AddUser)
+	service.handle("DELETE", "/users/:login", service.RemoveUser)
+	service.handle("PUT", "/users/:login", service.ChangeUser)
 	// токены устройств пользователя
-	mux.Handle("GET", "/apns/:topic/users/:login", service.GetTokens)
-	mux.Handle("POST", "/apns/:topic/users/:login", service.AddToken)
+	service.handle("GET", "/apns/:topic/users/:login", service.GetTokens)
+	service.handle("POST", "/apns/:topic/users/:login", service.AddToken)
+	// теги пользователей и токенов
+	service.handle("GET", "/apns/:topic/users/:login/tags", service.GetUserTags)
+	service.handle("PUT", "/apns/:topic/users/:login/tags", service.SetUserTags)
+	service.handle("GET", "/apns/:topic/tokens/:token/tags", service.GetTokenTags)
+	service.handle("PUT", "/apns/:topic/tokens/:token/tags", service.SetTokenTags)
+	// профиль пользователя: зона времени и тихие часы
+	service.handle("GET", "/apns/:topic/users/:login/profile", service.GetUserProfile)
+	service.handle("PUT", "/apns/:topic/users/:login/profile", service.SetUserProfile)
 	// отправка push-уведомлений
-	mux.Handle("POST", "/apns/:topic/push", service.Push)
-	mux.Handle("POST", "/apns/:topic/users/:login/push", service.PushUser)
+	service.handle("POST", "/apns/:topic/push",
+		service.idempotent(service.UserAuth,
+			service.limited(service.UserAuth, service.Push)))
+	service.handle("POST", "/apns/:topic/users/:login/push",
+		service.idempotent(service.UserAuth,
+			service.limited(service.UserAuth, service.PushUser)))
+	// история уведомлений пользователя
+	service.handle("GET", "/apns/:topic/users/:login/notifications", service.GetHistory)
+	service.handle("PUT", "/apns/:topic/users/:login/notifications", service.ReadHistory)
+	service.handle("PUT", "/apns/:topic/users/:login/notifications/:id", service.ReadHistoryItem)
+	service.handle("DELETE", "/apns/:topic/users/:login/notifications/:id", service.RemoveHistoryItem)
+	// счетчик непрочитанных уведомлений пользователя
+	service.handle("GET", "/apns/:topic/users/:login/badge", service.GetBadge)
+	service.handle("PUT", "/apns/:topic/users/:login/badge",
+		service.badgePush(service.SetBadge))
+	service.handle("DELETE", "/apns/:topic/users/:login/badge",
+		service.badgePush(service.ResetBadge))
+	// шаблоны уведомлений
+	service.handle("GET", "/apns/:topic/templates", service.GetTemplates)
+	service.handle("GET", "/apns/:topic/templates/:name", service.GetTemplate)
+	service.handle("PUT", "/apns/:topic/templates/:name", service.SetTemplate)
+	service.handle("DELETE", "/apns/:topic/templates/:name", service.RemoveTemplate)
+	// VoIP-уведомления о входящем звонке
+	service.handle("POST", "/apns/:topic/users/:login/call",
+		service.idempotent(service.UserAuth,
+			service.limited(service.UserAuth, service.PushCall)))
+	// Live Activities
+	service.handle("GET", "/apns/:topic/users/:login/pushtostart", service.GetPushToStartTokens)
+	service.handle("POST", "/apns/:topic/users/:login/pushtostart", service.AddPushToStartToken)
+	service.handle("POST", "/apns/:topic/users/:login/activities",
+		service.limited(service.UserAuth, service.StartActivity))
+	service.handle("POST", "/apns/:topic/users/:login/activities/:activity", service.AddActivityToken)
+	service.handle("PUT", "/apns/:topic/users/:login/activities/:activity",
+		service.limited(service.UserAuth, service.UpdateActivity))
+	service.handle("DELETE", "/apns/:topic/users/:login/activities/:activity",
+		service.limited(service.UserAuth, service.EndActivity))
+	// рассылка на все токены темы
+	service.handle("POST", "/apns/:topic/broadcast",
+		service.idempotent(service.AdminAuth, service.Broadcast))
+	service.handle("GET", "/apns/:topic/broadcast", service.GetJobs)
+	service.handle("GET", "/apns/:topic/broadcast/:id", service.GetJob)
+	service.handle("POST", "/apns/:topic/broadcast/:id", service.ResumeJob)
+	service.handle("DELETE", "/apns/:topic/broadcast/:id", service.CancelJob)
+	// подписки на события и журнал их доставки
+	service.handle("GET", "/webhooks", service.GetWebhooks)
+	service.handle("GET", "/webhooks/deliveries", service.GetDeliveries)
+	service.handle("POST", "/webhooks/deliveries/:id", service.Redeliver)
+	// использование квот уведомлений
+	service.handle("GET", "/usage", service.GetUsage)
+	// проверка работоспособности сервиса
+	service.handle("GET", "/healthz", service.Health)
+	service.handle("GET", "/readyz", service.Ready)
+	// описание API
+	service.handle("GET", "/openapi.json", service.OpenAPI)
+	// запускаем доставку событий подписчикам
+	if len(config.Webhooks) > 0 && config.hooks == nil {
+		config.hooks = newWebhookSender(config)
+		if err := config.hooks.Resume(); err != nil {
+			log.WithError(err).Error("resume webhooks error")
+		}
+	}
+	// включаем ограничение отправки на токены устройств
+	if config.Throttle != nil && config.throttle == nil {
+		config.throttle = newTokenThrottle(config)
+	}
+	// запускаем отправку уведомлений, отложенных до окончания тихих часов
+	if config.scheduler == nil {
+		config.scheduler = newPushScheduler(config)
+	}
+	// продолжаем прерванные задачи рассылки
+	if err := service.jobs.Resume(); err != nil {
+		log.WithError(err).Error("resume broadcast error")
+	}
 	return service
 }
 
+// handle регистрирует обработчик запроса. Клиентам, запросившим версию API
+// 1.2, ошибки обработчика отдаются в виде apiError.
+func (s *Service) handle(method, path string, handler rest.Handler) {
+	s.routes = append(s.routes, method+" "+path)
+	s.mux.Handle(method, path, func(c *rest.Context) error {
+		if !isAPIVersion(c.Request, apiVersion) {
+			return handler(c)
+		}
+		c.SetHeader("X-API-Version", apiVersion)
+		if err := handler(c); err != nil {
+			return writeError(c, err)
+		}
+		return nil
+	})
+}
+
 // AdminAuth проверяет авторизацию администратора. Возвращает 0, nil, если
 // администратор успешно авторизован.
 func (s *Service) AdminAuth(c *rest.Context) error {
 	if !s.config.IsAdminAuthorization() {
 		return nil // авторизация не требуется
 	}
+	// проверяем клиентский сертификат
+	if s.config.IsAdmin(s.certificateLogin(c)) {
+		return nil // администратор авторизован по сертификату
+	}
 	// разбираем заголовок с авторизацией
 	login, password, ok := c.BasicAuth()
 	if !ok {
@@ -93,6 +196,9 @@ func (s *Service) AddUser(c *rest.Context) error {
 	}
 	// добавляем информацию о пользователе
 	exist := s.config.AddUser(user.Login, user.Password)
+	if err := s.config.Save(); err != nil {
+		return err
+	}
 	// если это новый пользователь, то отдаем статус создания
 	var code = http.StatusOK
 	if !exist {
@@ -116,6 +222,9 @@ func (s *Service) RemoveUser(c *rest.Context) error {
 	if !exist {
 		return c.Error(http.StatusNotFound, fmt.Sprintf("user %s not registered", login))
 	}
+	if err := s.config.Save(); err != nil {
+		return err
+	}
 	// отдаем список пользователей
 	return c.Write(rest.JSON{"users": s.config.UsersList()})
 }
@@ -138,6 +247,9 @@ func (s *Service) ChangeUser(c *rest.Context) error {
 	}
 	// изменяем пароль пользователя
 	exist := s.config.AddUser(login, password.Password)
+	if err := s.config.Save(); err != nil {
+		return err
+	}
 	code := http.StatusOK
 	if !exist {
 		code = http.StatusCreated
@@ -153,6 +265,10 @@ func (s *Service) UserAuth(c *rest.Context) error {
 	if !s.config.IsUserAuthorization() {
 		return nil // авторизация не требуется
 	}
+	// проверяем клиентский сертификат
+	if s.config.IsUser(s.certificateLogin(c)) {
+		return nil // пользователь авторизован по сертификату
+	}
 	// разбираем заголовок с авторизацией
 	login, password, ok := c.BasicAuth()
 	if !ok {
@@ -167,6 +283,18 @@ func (s *Service) UserAuth(c *rest.Context) error {
 	return nil // администратор авторизован
 }
 
+// certificateLogin возвращает логин, сопоставленный с проверенным клиентским
+// сертификатом запроса. Если сертификат не передан, не проверен или не
+// сопоставлен ни с одним логином, то возвращается пустая строка.
+func (s *Service) certificateLogin(c *rest.Context) string {
+	var state = c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 ||
+		len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return s.config.CertificateLogin(state.PeerCertificates[0])
+}
+
 // GetTokens отдает список зарегистрированных токенов пользователя
 func (s *Service) GetTokens(c *rest.Context) error {
 	// проверяем авторизацию пользователя
@@ -183,8 +311,12 @@ func (s *Service) GetTokens(c *rest.Context) error {
 	}
 	query := c.Request.URL.Query()        // разобранные параметры запроса
 	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	kind := query.Get("kind")             // вид токенов
 	// запрашиваем список токенов пользователя
-	tokens, err := s.config.Store.GetUserTopicTokens(topic, sandbox, user)
+	tokens, err := s.config.Store.GetUserTokens(kind, topic, sandbox, user)
+	if err == ErrBadTokenKind {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
 	if err != nil {
 		return err
 	}
@@ -195,6 +327,14 @@ func (s *Service) GetTokens(c *rest.Context) error {
 	return c.Write(rest.JSON{"tokens": tokens})
 }
 
+// tokenRequest описывает запрос на регистрацию токена устройства.
+type tokenRequest struct {
+	Token    string `json:"token" form:"token"`
+	Kind     string `json:"kind" form:"kind"`
+	Locale   string `json:"locale" form:"locale"`
+	TimeZone string `json:"timeZone" form:"timeZone"`
+}
+
 // AddToken регистрирует токен пользовательского устройства.
 func (s *Service) AddToken(c *rest.Context) error {
 	// проверяем авторизацию пользователя
@@ -211,20 +351,36 @@ func (s *Service) AddToken(c *rest.Context) error {
 	}
 	query := c.Request.URL.Query()        // разобранные параметры запроса
 	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
-	var token = new(struct {
-		Token string `json:"token" form:"token"`
-	})
+	if err := validateBody(c, "TokenRequest"); err != nil {
+		return err
+	}
+	var token = new(tokenRequest)
 	err := c.Bind(token)
 	if err != nil {
 		return err
 	}
+	if err := validTimeZone(token.TimeZone); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
 	// сохраняем в хранилище токенов устройств
-	err = s.config.AddToken(user, topic, token.Token, sandbox)
+	err = s.config.AddToken(user, topic, token.Token, token.Kind, sandbox)
+	if err == ErrBadTokenKind {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
 	if err != nil {
 		return err
 	}
+	// сохраняем язык устройства для шаблонов уведомлений и зону времени для
+	// тихих часов
+	if token.Locale != "" || token.TimeZone != "" {
+		err = s.config.Store.SetTokenMeta(topic, token.Token, sandbox,
+			&TokenMeta{Locale: token.Locale, TimeZone: token.TimeZone})
+		if err != nil {
+			return err
+		}
+	}
 	// запрашиваем список токенов пользователя
-	tokens, err := s.config.Store.GetUserTopicTokens(topic, sandbox, user)
+	tokens, err := s.config.Store.GetUserTokens(token.Kind, topic, sandbox, user)
 	if err != nil {
 		return err
 	}
@@ -232,6 +388,191 @@ func (s *Service) AddToken(c *rest.Context) error {
 	return c.Write(rest.JSON{"tokens": tokens})
 }
 
+// pushRequest описывает общие параметры запроса на отправку уведомления.
+type pushRequest struct {
+	Payload     map[string]interface{}            `json:"payload" form:"payload"`
+	Expiration  time.Time                         `json:"expiration" form:"expiration"`
+	LowPriority bool                              `json:"lowPriority" form:"lowPriority"`
+	CollapseID  string                            `json:"collapseId" form:"collapseId"`
+	PushType    string                            `json:"pushType" form:"pushType"`
+	Alert       *Alert                            `json:"alert" form:"alert"`
+	Template    string                            `json:"template" form:"template"`
+	Vars        map[string]interface{}            `json:"vars" form:"vars"`
+	UserVars    map[string]map[string]interface{} `json:"userVars" form:"userVars"`
+	Truncate    bool                              `json:"truncate" form:"truncate"`
+	Urgent      bool                              `json:"urgent" form:"urgent"`
+}
+
+// Notification возвращает описание уведомления для указанной темы. Если в
+// запросе задан alert, то он объединяется с payload. Возвращает ошибку
+// PayloadError, если содержимое уведомления не задано или не корректно.
+func (r *pushRequest) Notification(topic string, sandbox bool) (
+	n Notification, err error) {
+	if len(r.Payload) == 0 && r.Alert == nil {
+		return n, PayloadError("empty payload")
+	}
+	var payload = r.Payload
+	if r.Alert != nil {
+		if err = r.Alert.Validate(); err != nil {
+			return n, err
+		}
+		payload = r.Alert.Merge(payload)
+	}
+	n = Notification{
+		Payload:     payload,
+		Expiration:  r.Expiration,
+		LowPriority: r.LowPriority,
+		Topic:       topic,
+		CollapseID:  r.CollapseID,
+		Sandbox:     sandbox,
+		PushType:    r.PushType,
+		Truncate:    r.Truncate,
+	}
+	return n, n.Validate()
+}
+
+// deliveryState описывает общие для запроса на отправку сведения о токенах.
+type deliveryState struct {
+	quiet   map[string]time.Time // окончание тихих часов токенов
+	history *historyRecorder     // история уведомлений пользователей
+	badges  *badgeCounter        // счетчики непрочитанных уведомлений
+}
+
+// deliver отправляет уведомление из запроса на указанные токены и возвращает
+// статусы отправки. Уведомление по шаблону формируется отдельно для каждого
+// токена. Если запрос не срочный, то для пользователей в тихих часах
+// уведомление откладывается до их окончания. Если для темы включена история,
+// то уведомление сохраняется в истории пользователей. Ошибка PayloadError
+// означает некорректный запрос.
+func (s *Service) deliver(request *pushRequest, topic string, sandbox bool,
+	tokens []string) (map[string]string, error) {
+	var state = new(deliveryState)
+	var err error
+	if !request.Urgent {
+		state.quiet, err = s.config.QuietUntil(topic, sandbox, tokens, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	state.history, err = s.config.newHistoryRecorder(topic, sandbox, tokens)
+	if err != nil {
+		return nil, err
+	}
+	defer state.history.Save()
+	state.badges, err = s.config.newBadgeCounter(topic, sandbox, tokens)
+	if err != nil {
+		return nil, err
+	}
+	if request.Template != "" {
+		return s.pushTemplate(request, topic, sandbox, tokens, state)
+	}
+	n, err := request.Notification(topic, sandbox)
+	if err != nil {
+		return nil, err
+	}
+	return s.pushTokens(n, tokens, state)
+}
+
+// pushTokens отправляет уведомление на токены с учетом сведений о них из
+// state: для токенов в тихих часах уведомление сохраняется в расписании до их
+// окончания, aps.badge со значением increment заменяется счетчиком
+// пользователя, а статусы отправки добавляются в историю.
+func (s *Service) pushTokens(notification Notification, tokens []string,
+	state *deliveryState) (sent map[string]string, err error) {
+	sent = make(map[string]string, len(tokens))
+	// push отправляет уведомление на группу токенов
+	push := func(n Notification, tokens []string) error {
+		// отложенная отправка обновляет статус в истории
+		n.History = state.history.ID()
+		var status = make(map[string]string, len(tokens))
+		defer func() {
+			state.history.Add(n, status)
+			for token, value := range status {
+				sent[token] = value
+			}
+		}()
+		var now []string // токены для немедленной отправки
+		for _, token := range tokens {
+			until, ok := state.quiet[token]
+			if !ok {
+				now = append(now, token)
+				continue
+			}
+			var scheduled = n
+			scheduled.Token = token
+			if err := s.config.Schedule(until, &scheduled); err != nil {
+				return err
+			}
+			status[token] = StatusScheduled
+		}
+		if len(now) == 0 {
+			return nil
+		}
+		pushed, err := s.config.Push(n, now)
+		for token, value := range pushed {
+			status[token] = value
+		}
+		return err
+	}
+	if state.badges == nil || !badgeIncrement(notification.Payload) {
+		return sent, push(notification, tokens)
+	}
+	// группируем токены по значению счетчика пользователя
+	var groups = make(map[int64][]string)
+	for _, token := range tokens {
+		badge, err := state.badges.Badge(token)
+		if err != nil {
+			return sent, err
+		}
+		groups[badge] = append(groups[badge], token)
+	}
+	for badge, tokens := range groups {
+		var n = notification
+		n.Payload = withBadge(n.Payload, badge)
+		// для токенов без пользователя aps.badge удаляется, и уведомление
+		// может оказаться пустым: такие токены пропускаются
+		if badge < 0 && n.Validate() != nil {
+			for _, token := range tokens {
+				sent[token] = StatusNoBadge
+			}
+			continue
+		}
+		if err := push(n, tokens); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// payloadError возвращает ошибку запроса для ошибок содержимого уведомления:
+// 413 для слишком большого содержимого и 400 для некорректного. Остальные
+// ошибки возвращаются как есть.
+func payloadError(c *rest.Context, err error) error {
+	switch err.(type) {
+	case *PayloadTooLargeError:
+		return c.Error(http.StatusRequestEntityTooLarge, err.Error())
+	case PayloadError:
+		return c.Error(http.StatusBadRequest, err.Error())
+	default:
+		return err
+	}
+}
+
+// writeSent отдает статусы отправки уведомлений. Ошибка содержимого
+// уведомления возвращается как ошибка запроса, а ошибка APNS — вместе со
+// статусами уже обработанных токенов.
+func writeSent(c *rest.Context, sent map[string]string, err error) error {
+	if apnserr, ok := err.(*Error); ok {
+		return &pushError{apns: apnserr, sent: sent}
+	}
+	if err != nil {
+		return payloadError(c, err)
+	}
+	countUsage(c, len(sent))
+	// отдаем количество отправленных сообщений
+	return c.Write(rest.JSON{"sent": sent})
+}
+
 // PushUser отправляет push-уведомления на все устройства пользователя.
 func (s *Service) PushUser(c *rest.Context) error {
 	// проверяем авторизацию пользователя
@@ -258,36 +599,28 @@ func (s *Service) PushUser(c *rest.Context) error {
 			fmt.Sprintf("tokens for user %s not registered", user))
 	}
 	// разбираем запроса для отправки уведомления
-	var notification = new(struct {
-		Payload     map[string]interface{} `json:"payload" form:"payload"`
-		Expiration  time.Time              `json:"expiration" form:"expiration"`
-		LowPriority bool                   `json:"lowPriority" form:"lowPriority"`
-		CollapseID  string                 `json:"collapseId" form:"collapseId"`
-	})
+	if err := validateBody(c, "PushRequest"); err != nil {
+		return err
+	}
+	var notification = new(pushRequest)
 	err = c.Bind(notification)
 	if err != nil {
 		return err
 	}
-	if len(notification.Payload) == 0 {
-		return c.Error(http.StatusBadRequest, "empty payload")
-	}
-	// формируем данные для уведомления
-	var n = Notification{
-		Payload:     notification.Payload,
-		Expiration:  notification.Expiration,
-		LowPriority: notification.LowPriority,
-		Topic:       topic,
-		CollapseID:  notification.CollapseID,
-		Sandbox:     sandbox,
-	}
-	// отправляем на все токены пользователя
-	// отправляем на все токены пользователя
-	sent, err := s.config.Push(n, tokens)
-	if err != nil {
+	if err := reserveUsage(c, len(tokens)); err != nil {
 		return err
 	}
-	// отдаем количество отправленных сообщений
-	return c.Write(rest.JSON{"sent": sent})
+	// отправляем на все токены пользователя
+	sent, err := s.deliver(notification, topic, sandbox, tokens)
+	return writeSent(c, sent, err)
+}
+
+// topicPushRequest описывает запрос на отправку уведомления пользователям
+// темы или выбранным по тегам получателям.
+type topicPushRequest struct {
+	pushRequest
+	Users    []string  `json:"users" form:"user"`
+	Audience *Audience `json:"audience" form:"audience"`
 }
 
 // Push отправляет push-уведомления на все устройства указанных в запросе
@@ -304,22 +637,16 @@ func (s *Service) Push(c *rest.Context) error {
 	query := c.Request.URL.Query()        // разобранные параметры запроса
 	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
 	// разбираем запроса для отправки уведомления
-	var notification = new(struct {
-		Payload     map[string]interface{} `json:"payload" form:"payload"`
-		Expiration  time.Time              `json:"expiration" form:"expiration"`
-		LowPriority bool                   `json:"lowPriority" form:"lowPriority"`
-		CollapseID  string                 `json:"collapseId" form:"collapseId"`
-		Users       []string               `json:"users" form:"user"`
-	})
+	if err := validateBody(c, "TopicPushRequest"); err != nil {
+		return err
+	}
+	var notification = new(topicPushRequest)
 	err := c.Bind(notification)
 	if err != nil {
 		return err
 	}
 
-	if len(notification.Payload) == 0 {
-		return c.Error(http.StatusBadRequest, "empty payload")
-	}
-	if len(notification.Users) == 0 {
+	if len(notification.Users) == 0 && notification.Audience == nil {
 		return c.Error(http.StatusBadRequest, "empty users list")
 	}
 	// получаем список токенов пользователя
@@ -328,23 +655,41 @@ func (s *Service) Push(c *rest.Context) error {
 	if err != nil {
 		return err
 	}
+	// добавляем токены, выбранные по тегам
+	if notification.Audience != nil {
+		if err := notification.Audience.Validate(); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+		audience, err := s.config.Store.GetAudienceTokens(topic, sandbox,
+			notification.Audience)
+		if err != nil {
+			return err
+		}
+		tokens = appendUnique(tokens, audience...)
+	}
 	if len(tokens) == 0 {
 		return c.Error(http.StatusNotFound, "tokens not registered")
 	}
-	// формируем данные для уведомления
-	var n = Notification{
-		Payload:     notification.Payload,
-		Expiration:  notification.Expiration,
-		LowPriority: notification.LowPriority,
-		Topic:       topic,
-		CollapseID:  notification.CollapseID,
-		Sandbox:     sandbox,
-	}
-	// отправляем на все токены пользователя
-	sent, err := s.config.Push(n, tokens)
-	if err != nil {
+	if err := reserveUsage(c, len(tokens)); err != nil {
 		return err
 	}
-	// отдаем количество отправленных сообщений
-	return c.Write(rest.JSON{"sent": sent})
+	// отправляем на все токены пользователя
+	sent, err := s.deliver(&notification.pushRequest, topic, sandbox, tokens)
+	return writeSent(c, sent, err)
+}
+
+// appendUnique добавляет к списку только те строки, которых в нем еще нет.
+func appendUnique(list []string, items ...string) []string {
+	var exist = make(map[string]struct{}, len(list))
+	for _, item := range list {
+		exist[item] = struct{}{}
+	}
+	for _, item := range items {
+		if _, ok := exist[item]; ok {
+			continue
+		}
+		exist[item] = struct{}{}
+		list = append(list, item)
+	}
+	return list
 }
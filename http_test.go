@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+const testTopic = "com.xyzrd.trackintouch"
+
+// testService описывает запущенный для тестов сервис вместе с сервером,
+// имитирующим APNS.
+type testService struct {
+	*testing.T
+	config  *Config
+	service *Service
+	server  *httptest.Server
+	apns    *mockapns.Server
+}
+
+// newTestService запускает сервис с временным хранилищем токенов и сервером
+// APNS, заданным mockapns. Все ресурсы освобождаются по окончании теста.
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	return newTestServiceConfig(t, nil)
+}
+
+// newTestServiceConfig запускает сервис так же, как newTestService, но перед
+// запуском позволяет изменить конфигурацию.
+func newTestServiceConfig(t *testing.T, setup func(*Config)) *testService {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	apns, err := mockapns.NewServer("", nil)
+	if err != nil {
+		store.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	provider, key := newTestProviderToken(t)
+	apns.PublicKey = &key.PublicKey // проверка подписи JWT
+	var config = &Config{
+		Provider: provider,
+		Store:    store,
+		APNS: &APNSConfig{
+			Production:  apns.URL,
+			Development: apns.URL,
+		},
+	}
+	if setup != nil {
+		setup(config)
+	}
+	config.client = apns.Client()
+	var service = NewService(config)
+	var ts = &testService{
+		T:       t,
+		config:  config,
+		service: service,
+		server:  httptest.NewServer(service.mux),
+		apns:    apns,
+	}
+	t.Cleanup(func() {
+		ts.server.Close()
+		ts.waitJobs()
+		apns.Close()
+		config.Close()
+		os.RemoveAll(dir)
+	})
+	return ts
+}
+
+// waitJobs ожидает завершения фоновых задач рассылки.
+func (ts *testService) waitJobs() {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		ts.service.jobs.mu.Lock()
+		running := len(ts.service.jobs.running)
+		ts.service.jobs.mu.Unlock()
+		if running == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.Error("broadcast jobs are still running")
+}
+
+// waitRequests ожидает получения сервером APNS указанного количества
+// запросов.
+func (ts *testService) waitRequests(n int) []*mockapns.Request {
+	ts.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if requests := ts.apns.Requests(); len(requests) >= n {
+			return requests
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.Fatalf("apns requests: %d, want %d", len(ts.apns.Requests()), n)
+	return nil
+}
+
+// testResponse описывает разобранный ответ сервиса.
+type testResponse struct {
+	Code    int             `json:"code"`
+	Status  string          `json:"status"`
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	header  http.Header
+}
+
+// Decode разбирает данные ответа.
+func (r *testResponse) Decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Data, v); err != nil {
+		t.Fatalf("bad response data %s: %v", r.Data, err)
+	}
+}
+
+// request выполняет запрос к сервису. Если указан body, то он передается в
+// формате JSON. Авторизация задается парой логин и пароль.
+func (ts *testService) request(method, path string, body interface{},
+	auth ...string) (int, *testResponse) {
+	ts.Helper()
+	var reader = new(bytes.Buffer)
+	if body != nil {
+		if err := json.NewEncoder(reader).Encode(body); err != nil {
+			ts.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.server.URL+path, reader)
+	if err != nil {
+		ts.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if len(auth) == 2 {
+		req.SetBasicAuth(auth[0], auth[1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ts.Fatal(err)
+	}
+	var response = &testResponse{header: resp.Header}
+	if resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, response); err != nil {
+			ts.Fatalf("%s %s: bad response %q: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode, response
+}
+
+// expect выполняет запрос и проверяет код ответа.
+func (ts *testService) expect(code int, method, path string, body interface{},
+	auth ...string) *testResponse {
+	ts.Helper()
+	status, resp := ts.request(method, path, body, auth...)
+	if status != code {
+		ts.Fatalf("%s %s: status %d, want %d", method, path, status, code)
+	}
+	return resp
+}
+
+// addTokens регистрирует токены устройств пользователя.
+func (ts *testService) addTokens(user string, sandbox bool, tokens ...string) {
+	ts.Helper()
+	var path = "/apns/" + testTopic + "/users/" + user
+	if sandbox {
+		path += "?sandbox"
+	}
+	for _, token := range tokens {
+		ts.expect(http.StatusCreated, "POST", path, map[string]string{
+			"token": token,
+		})
+	}
+}
+
+// tokens возвращает список токенов пользователя из ответа сервиса.
+func (ts *testService) tokens(user string, sandbox bool) []string {
+	ts.Helper()
+	var path = "/apns/" + testTopic + "/users/" + user
+	if sandbox {
+		path += "?sandbox"
+	}
+	status, resp := ts.request("GET", path, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if status != http.StatusOK {
+		ts.Fatalf("GET %s: status %d", path, status)
+	}
+	var data struct {
+		Tokens []string `json:"tokens"`
+	}
+	resp.Decode(ts.T, &data)
+	sort.Strings(data.Tokens)
+	return data.Tokens
+}
+
+// sent возвращает статусы отправки уведомлений из ответа сервиса.
+func sent(t *testing.T, resp *testResponse) map[string]string {
+	t.Helper()
+	var data struct {
+		Sent map[string]string `json:"sent"`
+	}
+	resp.Decode(t, &data)
+	return data.Sent
+}
+
+var testPayload = map[string]interface{}{
+	"payload": map[string]interface{}{
+		"aps": map[string]interface{}{"alert": "Test message"},
+	},
+}
+
+func TestUsers(t *testing.T) {
+	ts := newTestService(t)
+	users := func(resp *testResponse) []string {
+		var data struct {
+			Users []string `json:"users"`
+		}
+		resp.Decode(t, &data)
+		return data.Users
+	}
+	// без администратора авторизация не требуется
+	resp := ts.expect(http.StatusOK, "GET", "/users", nil)
+	if list := users(resp); len(list) != 0 {
+		t.Errorf("users: %v", list)
+	}
+	ts.config.SetAdmin("admin", "secret")
+	status, resp := ts.request("GET", "/users", nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("no auth: status %d", status)
+	}
+	if resp.header.Get("WWW-Authenticate") == "" {
+		t.Error("no WWW-Authenticate header")
+	}
+	ts.expect(http.StatusForbidden, "GET", "/users", nil, "admin", "bad")
+	ts.expect(http.StatusForbidden, "POST", "/users",
+		map[string]string{"login": "dmitrys", "password": "pass"}, "user", "secret")
+	// добавление, повторное добавление и изменение пароля
+	resp = ts.expect(http.StatusCreated, "POST", "/users",
+		map[string]string{"login": "dmitrys", "password": "pass"}, "admin", "secret")
+	if list := users(resp); !reflect.DeepEqual(list, []string{"dmitrys"}) {
+		t.Errorf("users: %v", list)
+	}
+	ts.expect(http.StatusOK, "POST", "/users",
+		map[string]string{"login": "dmitrys", "password": "pass2"}, "admin", "secret")
+	ts.expect(http.StatusBadRequest, "POST", "/users",
+		map[string]string{"password": "pass"}, "admin", "secret")
+	ts.expect(http.StatusCreated, "PUT", "/users/test",
+		map[string]string{"password": "test"}, "admin", "secret")
+	ts.expect(http.StatusOK, "PUT", "/users/test",
+		map[string]string{"password": "test2"}, "admin", "secret")
+	resp = ts.expect(http.StatusOK, "GET", "/users", nil, "admin", "secret")
+	if list := users(resp); !reflect.DeepEqual(list, []string{"dmitrys", "test"}) {
+		t.Errorf("users: %v", list)
+	}
+	if !ts.config.UserAuthorization("dmitrys", "pass2") {
+		t.Error("password not changed")
+	}
+	// удаление
+	resp = ts.expect(http.StatusOK, "DELETE", "/users/test", nil, "admin", "secret")
+	if list := users(resp); !reflect.DeepEqual(list, []string{"dmitrys"}) {
+		t.Errorf("users: %v", list)
+	}
+	ts.expect(http.StatusNotFound, "DELETE", "/users/test", nil, "admin", "secret")
+}
+
+func TestUserAuth(t *testing.T) {
+	ts := newTestService(t)
+	var path = "/apns/" + testTopic + "/users/dmitrys"
+	var token = map[string]string{"token": "EF2A1B9AF717"}
+	// без пользователей авторизация не требуется
+	ts.expect(http.StatusCreated, "POST", path, token)
+	ts.config.AddUser("dmitrys", "pass")
+	status, resp := ts.request("POST", path, token)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("no auth: status %d", status)
+	}
+	if resp.header.Get("WWW-Authenticate") == "" {
+		t.Error("no WWW-Authenticate header")
+	}
+	ts.expect(http.StatusForbidden, "POST", path, token, "dmitrys", "bad")
+	ts.expect(http.StatusForbidden, "POST", path, token, "unknown", "pass")
+	ts.expect(http.StatusCreated, "POST", path, token, "dmitrys", "pass")
+	ts.expect(http.StatusOK, "GET", path, nil, "dmitrys", "pass")
+	ts.expect(http.StatusOK, "POST", path+"/push", testPayload, "dmitrys", "pass")
+}
+
+func TestTokens(t *testing.T) {
+	ts := newTestService(t)
+	if tokens := ts.tokens("dmitrys", false); tokens != nil {
+		t.Fatalf("tokens before registration: %v", tokens)
+	}
+	ts.addTokens("dmitrys", false, "BBBB", "AAAA")
+	ts.addTokens("dmitrys", true, "CCCC")
+	ts.addTokens("test", false, "DDDD")
+	// повторная регистрация не добавляет токен
+	ts.addTokens("dmitrys", false, "AAAA")
+	if tokens := ts.tokens("dmitrys", false); !reflect.DeepEqual(tokens,
+		[]string{"AAAA", "BBBB"}) {
+		t.Errorf("production tokens: %v", tokens)
+	}
+	if tokens := ts.tokens("dmitrys", true); !reflect.DeepEqual(tokens,
+		[]string{"CCCC"}) {
+		t.Errorf("sandbox tokens: %v", tokens)
+	}
+	// токен переходит к другому пользователю
+	ts.addTokens("test", false, "BBBB")
+	if tokens := ts.tokens("dmitrys", false); !reflect.DeepEqual(tokens,
+		[]string{"AAAA"}) {
+		t.Errorf("tokens after move: %v", tokens)
+	}
+	if tokens := ts.tokens("test", false); !reflect.DeepEqual(tokens,
+		[]string{"BBBB", "DDDD"}) {
+		t.Errorf("tokens after move: %v", tokens)
+	}
+	ts.expect(http.StatusBadRequest, "POST", "/apns/"+testTopic+"/users/dmitrys",
+		map[string]string{"token": "EEEE", "kind": "unknown"})
+	ts.expect(http.StatusBadRequest, "GET",
+		"/apns/"+testTopic+"/users/dmitrys?kind=unknown", nil)
+}
+
+func TestPush(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB", "CCCC")
+	ts.addTokens("test", false, "DDDD")
+	ts.addTokens("dmitrys", true, "EEEE")
+	ts.apns.Respond("BBBB", mockapns.BadDeviceToken)
+	ts.apns.Respond("CCCC", mockapns.Unregistered(time.Now()))
+	resp := ts.expect(http.StatusOK, "POST",
+		"/apns/"+testTopic+"/users/dmitrys/push", map[string]interface{}{
+			"payload":     map[string]interface{}{"aps": map[string]interface{}{"alert": "Test"}},
+			"lowPriority": true,
+			"collapseId":  "cid",
+		})
+	var want = map[string]string{
+		"AAAA": "OK",
+		"BBBB": reasons["BadDeviceToken"],
+		"CCCC": reasons["Unregistered"],
+	}
+	if status := sent(t, resp); !reflect.DeepEqual(status, want) {
+		t.Errorf("sent: %v", status)
+	}
+	// запросы к APNS
+	requests := ts.apns.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("apns requests: %d", len(requests))
+	}
+	for _, req := range requests {
+		if topic := req.Header.Get("apns-topic"); topic != testTopic {
+			t.Errorf("apns-topic: %q", topic)
+		}
+		if priority := req.Header.Get("apns-priority"); priority != "5" {
+			t.Errorf("apns-priority: %q", priority)
+		}
+		if id := req.Header.Get("apns-collapse-id"); id != "cid" {
+			t.Errorf("apns-collapse-id: %q", id)
+		}
+		if auth := req.Header.Get("authorization"); !strings.HasPrefix(auth, "bearer ") {
+			t.Errorf("authorization: %q", auth)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			t.Errorf("payload %s: %v", req.Payload, err)
+		}
+	}
+	// недействительные токены удалены из хранилища
+	if tokens := ts.tokens("dmitrys", false); !reflect.DeepEqual(tokens,
+		[]string{"AAAA"}) {
+		t.Errorf("tokens after push: %v", tokens)
+	}
+	// рассылка нескольким пользователям и в sandbox
+	ts.apns.Reset()
+	resp = ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/push",
+		map[string]interface{}{
+			"payload": testPayload["payload"],
+			"users":   []string{"dmitrys", "test"},
+		})
+	want = map[string]string{"AAAA": "OK", "DDDD": "OK"}
+	if status := sent(t, resp); !reflect.DeepEqual(status, want) {
+		t.Errorf("sent: %v", status)
+	}
+	resp = ts.expect(http.StatusOK, "POST",
+		"/apns/"+testTopic+"/users/dmitrys/push?sandbox", testPayload)
+	want = map[string]string{"EEEE": "OK"}
+	if status := sent(t, resp); !reflect.DeepEqual(status, want) {
+		t.Errorf("sandbox sent: %v", status)
+	}
+	if n := len(ts.apns.Requests()); n != 3 {
+		t.Errorf("apns requests: %d", n)
+	}
+}
+
+func TestPushGoAway(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	ts.apns.Respond("AAAA", mockapns.GoAway("Shutdown"), mockapns.OK)
+	// ошибка соединения прерывает отправку, но токен не удаляется
+	status, _ := ts.request("POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		testPayload)
+	if status < http.StatusInternalServerError {
+		t.Errorf("goaway: status %d", status)
+	}
+	resp := ts.expect(http.StatusOK, "POST",
+		"/apns/"+testTopic+"/users/dmitrys/push", testPayload)
+	if status := sent(t, resp); status["AAAA"] != "OK" {
+		t.Errorf("sent after goaway: %v", status)
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	// пользователь без токенов
+	ts.expect(http.StatusNotFound, "POST", "/apns/"+testTopic+"/users/test/push",
+		testPayload)
+	// пустое и некорректное уведомление
+	ts.expect(http.StatusBadRequest, "POST", path, map[string]interface{}{})
+	ts.expect(http.StatusBadRequest, "POST", path, map[string]interface{}{
+		"payload":  testPayload["payload"],
+		"pushType": "unknown",
+	})
+	// слишком большое уведомление
+	ts.expect(http.StatusRequestEntityTooLarge, "POST", path,
+		map[string]interface{}{
+			"payload": map[string]interface{}{
+				"aps": map[string]interface{}{
+					"alert": strings.Repeat("x", MaxPayloadSize),
+				},
+			},
+		})
+	// ошибка APNS, не связанная с токеном, прерывает отправку
+	ts.apns.Respond("AAAA", mockapns.Response{
+		Status: http.StatusInternalServerError,
+		Reason: "InternalServerError",
+	})
+	status, _ := ts.request("POST", path, testPayload)
+	if status < http.StatusInternalServerError {
+		t.Errorf("internal server error: status %d", status)
+	}
+	if tokens := ts.tokens("dmitrys", false); len(tokens) != 1 {
+		t.Errorf("tokens after error: %v", tokens)
+	}
+	// уведомления не отправлялись на сервер APNS, кроме последнего
+	if n := len(ts.apns.Requests()); n != 1 {
+		t.Errorf("apns requests: %d", n)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := newTestService(t)
+	ts.expect(http.StatusOK, "GET", "/healthz", nil)
+	resp := ts.expect(http.StatusOK, "GET", "/readyz?apns", nil)
+	var data struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	resp.Decode(t, &data)
+	if data.Status != "ok" || len(data.Checks) != 3 {
+		t.Errorf("readyz: %+v", data)
+	}
+	ts.config.Provider = nil
+	ts.expect(http.StatusServiceUnavailable, "GET", "/readyz", nil)
+}
+
+func TestAPNSClient(t *testing.T) {
+	ts := newTestService(t)
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var filename = filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(filename, ts.apns.CertificatePEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// клиент доверяет сертификатам из файла, а клиент по умолчанию не меняется
+	client, err := newAPNSClient(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAPNSConnection(client, ts.apns.URL); err != nil {
+		t.Errorf("connection: %v", err)
+	}
+	if client == httpAPNSClient || httpAPNSClient.Transport == client.Transport {
+		t.Error("default client changed")
+	}
+	if _, err := newAPNSClient(filepath.Join(dir, "none.pem")); err == nil {
+		t.Error("missing certificates file")
+	}
+}
+
+func TestPushProviderToken(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	jwt, err := ts.config.Provider.JWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// недавно созданный токен не заменяется и запрос не повторяется
+	ts.apns.Respond("AAAA", mockapns.Response{
+		Status: http.StatusForbidden,
+		Reason: "ExpiredProviderToken",
+	}, mockapns.OK)
+	status, _ := ts.request("POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		testPayload)
+	if status < http.StatusInternalServerError {
+		t.Errorf("expired provider token: status %d", status)
+	}
+	if n := len(ts.apns.Requests()); n != 1 {
+		t.Errorf("apns requests: %d", n)
+	}
+	if token, _ := ts.config.Provider.JWT(); token != jwt {
+		t.Error("provider token changed")
+	}
+	if tokens := ts.tokens("dmitrys", false); len(tokens) != 1 {
+		t.Errorf("tokens after error: %v", tokens)
+	}
+	// токен, созданный раньше JWTMinInterval, заменяется и запрос повторяется
+	ts.apns.Reset()
+	ts.config.Provider.created = time.Now().Add(-JWTMinInterval)
+	ts.apns.Respond("AAAA", mockapns.Response{
+		Status: http.StatusForbidden,
+		Reason: "InvalidProviderToken",
+	}, mockapns.OK)
+	resp := ts.expect(http.StatusOK, "POST",
+		"/apns/"+testTopic+"/users/dmitrys/push", testPayload)
+	if status := sent(t, resp); status["AAAA"] != "OK" {
+		t.Errorf("sent: %v", status)
+	}
+	requests := ts.apns.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("apns requests: %d", len(requests))
+	}
+	if auth := requests[0].Header.Get("authorization"); auth != jwt {
+		t.Errorf("first authorization: %q", auth)
+	}
+	if auth := requests[1].Header.Get("authorization"); auth == jwt {
+		t.Error("provider token not renewed")
+	}
+}
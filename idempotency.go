@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// IdempotencyConfig описывает настройки обработки заголовка Idempotency-Key.
+type IdempotencyConfig struct {
+	// Window задает время хранения ответа на запрос с ключом.
+	Window Duration `json:"window,omitempty"`
+}
+
+const (
+	// defaultIdempotencyWindow задает время хранения ответа по умолчанию.
+	defaultIdempotencyWindow = 24 * time.Hour
+	// idempotencyLockTimeout задает время, после которого незавершенный
+	// запрос с ключом считается прерванным и может быть выполнен повторно.
+	idempotencyLockTimeout = 5 * time.Minute
+)
+
+// IdempotencyWindow возвращает время хранения ответов на запросы с ключом.
+func (c *Config) IdempotencyWindow() time.Duration {
+	if c.Idempotency != nil && c.Idempotency.Window > 0 {
+		return time.Duration(c.Idempotency.Window)
+	}
+	return defaultIdempotencyWindow
+}
+
+// IdempotencyRecord описывает сохраненный запрос с ключом идемпотентности.
+// Нулевой статус означает, что запрос еще выполняется.
+type IdempotencyRecord struct {
+	Fingerprint string    `json:"fingerprint"` // хеш запроса
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// responseRecorder сохраняет копию ответа обработчика.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotent возвращает обработчик, который для запросов с заголовком
+// Idempotency-Key сохраняет успешный ответ и отдает его повторно вместо
+// выполнения запроса с тем же ключом. Так же сохраняется ответ на отправку,
+// прерванную ошибкой APNS после доставки части уведомлений. Ключ, повторно
+// использованный с другим запросом, отклоняется со статусом 422, а пока запрос
+// с ключом выполняется — со статусом 409. Авторизация проверяется до
+// обращения к сохраненному ответу.
+func (s *Service) idempotent(auth, handler rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		key := c.Request.Header.Get("Idempotency-Key")
+		if key == "" {
+			return handler(c)
+		}
+		if err := auth(c); err != nil {
+			return err
+		}
+		// ключи разных пользователей не пересекаются
+		login, _, _ := c.BasicAuth()
+		if login == "" {
+			login = s.certificateLogin(c)
+		}
+		key = login + "\x00" + key
+		// отпечаток запроса: метод, путь с параметрами и тело
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return err
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		var now = time.Now().UTC()
+		var record = &IdempotencyRecord{
+			Fingerprint: hex.EncodeToString(hash.Sum(nil)),
+			Created:     now,
+			Expires:     now.Add(s.config.IdempotencyWindow()),
+		}
+		stored, err := s.config.Store.BeginIdempotent(key, record)
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			switch {
+			case stored.Fingerprint != record.Fingerprint:
+				return c.Error(http.StatusUnprocessableEntity,
+					"idempotency key reused with a different request")
+			case stored.Status == 0:
+				return c.Error(http.StatusConflict,
+					"request with this idempotency key is in progress")
+			}
+			// отдаем сохраненный ответ
+			c.SetHeader("Content-Type", stored.ContentType)
+			c.SetHeader("Idempotent-Replayed", "true")
+			c.Response.WriteHeader(stored.Status)
+			_, err = c.Response.Write(stored.Body)
+			return err
+		}
+		var recorder = &responseRecorder{ResponseWriter: c.Response}
+		c.Response = recorder
+		err = handler(c)
+		// повтор прерванной отправки доставил бы уведомления повторно, поэтому
+		// ошибка после частичной отправки сохраняется вместе со статусами
+		// отправки на токены в том виде, который ожидает клиент
+		var partial bool
+		if pusherr, ok := err.(*pushError); ok && pusherr.delivered() {
+			partial = true
+			if isAPIVersion(c.Request, apiVersion) {
+				err = writeError(c, pusherr)
+			} else {
+				err = writePushError(c, pusherr)
+			}
+		}
+		c.Response = recorder.ResponseWriter
+		// сохраняется только успешный ответ, иначе запрос можно повторить
+		if err != nil || !partial &&
+			(recorder.status < 200 || recorder.status > 299) {
+			err2 := s.config.Store.RemoveIdempotent(key, record)
+			if err2 != nil {
+				log.WithError(err2).Error("remove idempotency key error")
+			}
+			return err
+		}
+		record.Status = recorder.status
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if err := s.config.Store.CompleteIdempotent(key, record); err != nil {
+			log.WithError(err).Error("save idempotency key error")
+		}
+		return nil
+	}
+}
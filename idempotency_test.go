@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	// push отправляет запрос с ключом идемпотентности
+	push := func(key, body string) (int, http.Header, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("POST", ts.server.URL+path,
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Idempotency-Key", key)
+		if version != "" {
+			req.Header.Set("X-API-Version", version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header, data
+	}
+	const body = `{"payload":{"aps":{"alert":"Test message"}}}`
+	status, header, first := push("key-1", body)
+	if status != http.StatusOK || header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: %d %s", status, first)
+	}
+	// повтор отдает сохраненный ответ без отправки в APNS
+	status, header, replay := push("key-1", body)
+	if status != http.StatusOK || header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay: %d %v", status, header)
+	}
+	if !bytes.Equal(first, replay) {
+		t.Errorf("replay body %s, want %s", replay, first)
+	}
+	if n := len(ts.apns.Requests()); n != 2 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// ключ с другим запросом отклоняется
+	if status, _, _ := push("key-1", `{"payload":{"aps":{"alert":"Other"}}}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: status %d", status)
+	}
+	// ответ с ошибкой не сохраняется
+	if status, _, _ := push("key-2", `{}`); status != http.StatusBadRequest {
+		t.Errorf("bad request: status %d", status)
+	}
+	if status, header, _ := push("key-2", body); status != http.StatusOK ||
+		header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("after error: status %d", status)
+	}
+	if n := len(ts.apns.Requests()); n != 4 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// ключи разных пользователей не пересекаются
+	ts.config.AddUser("dmitrys", "pass")
+	req, _ := http.NewRequest("POST", ts.server.URL+path, bytes.NewBufferString(body))
+	req.Header.Set("Idempotency-Key", "key-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replay without auth: status %d", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyKeyPartialPush(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB", "CCCC")
+	ts.apns.Respond("BBBB", mockapns.Response{
+		Status: http.StatusBadRequest,
+		Reason: "BadTopic",
+	})
+	// push отправляет уведомление с ключом идемпотентности
+	push := func(key, version string) (int, http.Header, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("POST", ts.server.URL+"/apns/"+testTopic+
+			"/users/dmitrys/push",
+			bytes.NewBufferString(`{"payload":{"aps":{"alert":"Test message"}}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Idempotency-Key", key)
+		if version != "" {
+			req.Header.Set("X-API-Version", version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header, data
+	}
+	// клиенты прежних версий API получают ошибку в прежнем виде
+	status, _, first := push("key-1", "")
+	var legacy struct {
+		Error string            `json:"error"`
+		Sent  map[string]string `json:"sent"`
+	}
+	if err := json.Unmarshal(first, &legacy); err != nil {
+		t.Fatalf("bad response %s: %v", first, err)
+	}
+	if status != http.StatusInternalServerError || legacy.Error == "" ||
+		len(legacy.Sent) != 2 || legacy.Sent["AAAA"] != "OK" {
+		t.Fatalf("partial push: %d %s", status, first)
+	}
+	// повтор не отправляет уведомления повторно
+	status, header, replay := push("key-1", "")
+	if status != http.StatusInternalServerError ||
+		header.Get("Idempotent-Replayed") != "true" || !bytes.Equal(first, replay) {
+		t.Errorf("replay: %d %v %s", status, header, replay)
+	}
+	if n := len(ts.apns.Requests()); n != 2 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// клиенты API 1.2 получают статусы токенов в описании ошибки
+	ts.apns.Reset()
+	ts.apns.Respond("BBBB", mockapns.Response{
+		Status: http.StatusBadRequest,
+		Reason: "BadTopic",
+	})
+	status, _, first = push("key-3", apiVersion)
+	var result struct {
+		Error *apiError `json:"error"`
+	}
+	if err := json.Unmarshal(first, &result); err != nil {
+		t.Fatalf("bad response %s: %v", first, err)
+	}
+	if status != http.StatusBadRequest || result.Error == nil ||
+		result.Error.Reason != "BadTopic" || len(result.Error.Tokens) != 2 ||
+		result.Error.Tokens[0] != (tokenStatus{"AAAA", "OK"}) {
+		t.Fatalf("partial push 1.2: %d %s", status, first)
+	}
+	if status, header, replay := push("key-3", apiVersion); status != http.StatusBadRequest ||
+		header.Get("Idempotent-Replayed") != "true" || !bytes.Equal(first, replay) {
+		t.Errorf("replay 1.2: %d %v %s", status, header, replay)
+	}
+	// если ничего не отправлено, ключ освобождается
+	ts.apns.Reset()
+	ts.apns.Respond("AAAA", mockapns.Response{
+		Status: http.StatusBadRequest,
+		Reason: "BadTopic",
+	})
+	if status, _, _ := push("key-2", ""); status != http.StatusInternalServerError {
+		t.Errorf("failed push: status %d", status)
+	}
+	ts.apns.Reset()
+	if status, header, _ := push("key-2", ""); status != http.StatusOK ||
+		header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry failed push: status %d", status)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter ограничивает частоту событий по алгоритму token bucket: корзина
+// емкостью burst пополняется со скоростью rate событий в секунду. Пустой
+// (nil) Limiter не ограничивает ничего.
+type Limiter struct {
+	rate   float64   // скорость пополнения (событий в секунду)
+	burst  float64   // емкость корзины
+	tokens float64   // текущее количество событий в корзине
+	last   time.Time // время последнего пополнения
+	mu     sync.Mutex
+}
+
+// NewLimiter возвращает новый ограничитель частоты событий. Если rate не
+// положительный, то возвращается nil — ограничения нет.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill пополняет корзину по прошедшему времени. Вызывается с блокировкой.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Reserve резервирует одно событие и возвращает время, которое необходимо
+// подождать перед тем, как оно может произойти.
+func (l *Limiter) Reserve() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return delay
+}
+
+// Wait ожидает возможности для следующего события. Возвращает false, если
+// ожидание было прервано закрытием канала stop.
+func (l *Limiter) Wait(stop <-chan struct{}) bool {
+	delay := l.Reserve()
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Allow забирает одно событие из корзины, если оно доступно, и возвращает
+// состояние корзины: Reset содержит время до ее полного пополнения. Если
+// корзина пуста, то событие не забирается, возвращается false, а Reset
+// содержит время до появления следующего события.
+func (l *Limiter) Allow() (*LimitState, bool) {
+	if l == nil {
+		return nil, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	var state = &LimitState{Limit: int64(l.burst)}
+	if l.tokens < 1 {
+		state.Reset = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		return state, false
+	}
+	l.tokens--
+	state.Remaining = int64(l.tokens)
+	state.Reset = time.Duration((l.burst - l.tokens) / l.rate * float64(time.Second))
+	return state, true
+}
+
+// Release возвращает в корзину событие, забранное Allow, если оно так и не
+// произошло.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.tokens++; l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mu.Unlock()
+}
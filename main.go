@@ -1,33 +1,52 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
-
 	"github.com/mdigger/log"
 )
 
 var (
-	appName = "pusher"                      // название сервиса
-	version = "2.1.21"                      // версия
-	date    = "2016-10-10"                  // дата сборки
-	build   = ""                            // номер сборки в git-репозитории
-	host    = "pushsvr.connector73.net:443" // адрес сервера и порт
-	config  = appName + ".json"             // имя конфигурационного файла
+	appName = "pusher"          // название сервиса
+	version = "2.1.21"          // версия
+	date    = "2016-10-10"      // дата сборки
+	build   = ""                // номер сборки в git-репозитории
+	host    = ""                // адрес сервера и порт
+	config  = appName + ".json" // имя конфигурационного файла
 	agent   = fmt.Sprintf("%s/%s", appName, version)
 )
 
 func main() {
 	log.SetLevel(log.DebugLevel)
 	log.SetFlags(0)
+	// без подкоманды или с флагами запускается сервер
+	var name, args = "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	if name != "serve" && name != "mock-apns" {
+		log.SetLevel(log.WarningLevel) // только ошибки административных команд
+	}
+	if err := command(args); err != nil {
+		log.WithError(err).Error(name + " error")
+		os.Exit(1)
+	}
+}
+
+// runServe запускает сервис и ожидает сигнала для остановки.
+func runServe(args []string) error {
 	// выводим информацию о версии сборки
 	log.WithFields(log.Fields{
 		"version": version,
@@ -37,18 +56,29 @@ func main() {
 	}).Info("starting service")
 
 	// разбираем параметры запуска приложения
-	flag.StringVar(&config, "config", config, "config `filename`")
-	flag.StringVar(&host, "address", host, "server address and `port`")
-	flag.Parse()
+	var flags = flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&config, "config", config, "config `filename`")
+	flags.StringVar(&host, "address", host, "server address and `port`")
+	flags.Parse(args)
 
 	// загружаем конфигурацию сервиса
 	log.WithField("file", config).Info("loading config")
 	serviceConfig, err := LoadConfig(config)
 	if err != nil {
-		log.WithError(err).Error("loading config error")
-		os.Exit(1)
+		return err
 	}
 	defer serviceConfig.Close()
+	// адрес сервера из параметров запуска имеет приоритет над конфигурацией
+	if host == "" {
+		host = serviceConfig.Address
+	}
+	if host == "" {
+		if serviceConfig.TLS != nil {
+			host = ":https"
+		} else {
+			host = ":http"
+		}
+	}
 	// инициализируем сервис
 	var service = NewService(serviceConfig)
 	// инициализируем HTTP-сервер
@@ -59,50 +89,28 @@ func main() {
 		WriteTimeout: time.Second * 120,
 	}
 	// для защищенного соединения проделываем дополнительные настройки
-	host, port, err := net.SplitHostPort(host)
-	if err != nil {
-		log.WithError(err).Error("bad server address")
-		os.Exit(2)
-	}
-	if port == "https" || port == "443" {
-		if host != "localhost" && host != "127.0.0.1" {
-			manager := autocert.Manager{
-				Prompt:     autocert.AcceptTOS,
-				HostPolicy: autocert.HostWhitelist(host),
-				Email:      "dmitrys@xyzrd.com",
-				Cache:      autocert.DirCache("letsEncript.cache"),
-			}
-			server.TLSConfig = &tls.Config{
-				GetCertificate: manager.GetCertificate,
-			}
-		} else {
-			// исключительно для отладки
-			cert, err := tls.X509KeyPair(LocalhostCert, LocalhostKey)
-			if err != nil {
-				panic(fmt.Sprintf("local certificates error: %v", err))
-			}
-			server.TLSConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-			}
+	if serviceConfig.TLS != nil {
+		tlsConfig, redirect, err := serviceConfig.TLS.Config()
+		if err != nil {
+			log.WithError(err).Error("tls config error")
+			os.Exit(2)
 		}
+		server.TLSConfig = tlsConfig
 		// запускаем автоматический переход для HTTP на HTTPS
-		go func() {
-			log.Info("starting http redirect")
-			err := http.ListenAndServe(":http", http.HandlerFunc(
-				func(w http.ResponseWriter, r *http.Request) {
-					http.Redirect(w, r,
-						"https://"+r.Host+r.URL.String(),
-						http.StatusMovedPermanently)
-				}))
-			if err != nil {
-				log.WithError(err).Warning("http redirect server error")
-			}
-		}()
+		if serviceConfig.TLS.Redirect {
+			go func() {
+				log.Info("starting http redirect")
+				err := http.ListenAndServe(":http", redirect)
+				if err != nil {
+					log.WithError(err).Warning("http redirect server error")
+				}
+			}()
+		}
 		// запускаем основной сервер
 		go func() {
 			log.WithFields(log.Fields{
 				"address": server.Addr,
-				"host":    host,
+				"hosts":   serviceConfig.TLS.Hosts,
 			}).Info("starting https")
 			err = server.ListenAndServeTLS("", "")
 			// корректно закрываем сервисы по окончании работы
@@ -122,6 +130,7 @@ func main() {
 	// инициализируем поддержку системных сигналов и ждем, когда он случится
 	monitorSignals(os.Interrupt, os.Kill)
 	log.Info("service stoped")
+	return nil
 }
 
 // monitorSignals запускает мониторинг сигналов и возвращает значение, когда
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/pusher/mockapns"
+)
+
+// runMockAPNS запускает локальную имитацию сервера APNS и ожидает сигнала
+// для остановки.
+func runMockAPNS(args []string) error {
+	var (
+		flags    = flag.NewFlagSet("mock-apns", flag.ExitOnError)
+		address  = flags.String("address", "127.0.0.1:2197", "server address and `port`")
+		keyFile  = flags.String("key", "", "provider `file` with .p8 private or PEM public key to verify JWT")
+		script   = flags.String("script", "", "JSON `file` with responses for tokens")
+		caFile   = flags.String("ca", "", "write server certificate to PEM `file`")
+		certFile = flags.String("cert", "", "server certificate `file`")
+		certKey  = flags.String("certkey", "", "server certificate key `file`")
+	)
+	flags.Parse(args)
+	var cert *tls.Certificate
+	if *certFile != "" {
+		pair, err := tls.LoadX509KeyPair(*certFile, *certKey)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+	server, err := mockapns.NewServer(*address, cert)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	if *keyFile != "" {
+		if server.PublicKey, err = loadPublicKey(*keyFile); err != nil {
+			return err
+		}
+	}
+	// загружаем заданные ответы для токенов
+	if *script != "" {
+		data, err := ioutil.ReadFile(*script)
+		if err != nil {
+			return err
+		}
+		var responses map[string][]mockapns.Response
+		if err := json.Unmarshal(data, &responses); err != nil {
+			return err
+		}
+		for token, list := range responses {
+			server.Respond(token, list...)
+		}
+	}
+	if *caFile != "" {
+		if err := ioutil.WriteFile(*caFile, server.CertificatePEM(), 0644); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"url":    server.URL,
+		"verify": server.PublicKey != nil,
+	}).Info("mock apns started")
+	monitorSignals(os.Interrupt, os.Kill)
+	log.Info("mock apns stoped")
+	return nil
+}
+
+// loadPublicKey загружает публичный ключ для проверки JWT из файла с
+// приватным ключом провайдера (.p8) или с публичным ключом в формате PEM.
+func loadPublicKey(filename string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, rest := pem.Decode(data)
+	if block != nil {
+		data = block.Bytes
+	} else {
+		data = rest
+	}
+	if private, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		if key, ok := private.(*ecdsa.PrivateKey); ok {
+			return &key.PublicKey, nil
+		}
+		return nil, ErrPTBadPrivateKey
+	}
+	public, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := public.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrPTBadPrivateKey
+	}
+	return key, nil
+}
@@ -0,0 +1,517 @@
+// Package mockapns реализует локальный сервер, имитирующий HTTP/2 API Apple
+// Push Notification Service, для тестов и отладки без доступа к Apple.
+//
+// Сервер принимает запросы POST /3/device/<token>, проверяет наличие JWT в
+// заголовке authorization (и его подпись, если задан публичный ключ) и
+// отвечает заданными для токена ответами: по умолчанию 200, а также любыми
+// ошибками APNS или закрытием соединения с фреймом GOAWAY.
+package mockapns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Response описывает ответ сервера на запрос отправки уведомления.
+type Response struct {
+	Status    int    `json:"status"`              // HTTP-статус ответа
+	Reason    string `json:"reason,omitempty"`    // причина ошибки APNS
+	Timestamp int64  `json:"timestamp,omitempty"` // время в миллисекундах для 410
+	GoAway    bool   `json:"goAway,omitempty"`    // закрыть соединение с GOAWAY
+	// Wait задерживает ответ до закрытия канала. Пока ответ задержан,
+	// остальные запросы того же соединения не обрабатываются.
+	Wait <-chan struct{} `json:"-"`
+}
+
+// Часто используемые ответы сервера.
+var (
+	OK              = Response{Status: http.StatusOK}
+	BadDeviceToken  = Response{Status: http.StatusBadRequest, Reason: "BadDeviceToken"}
+	TooManyRequests = Response{Status: http.StatusTooManyRequests, Reason: "TooManyRequests"}
+)
+
+// Unregistered возвращает ответ 410 для токена, который перестал быть
+// действительным в указанное время.
+func Unregistered(timestamp time.Time) Response {
+	return Response{
+		Status:    http.StatusGone,
+		Reason:    "Unregistered",
+		Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// GoAway возвращает ответ, при котором сервер закрывает соединение фреймом
+// GOAWAY с указанной причиной.
+func GoAway(reason string) Response {
+	return Response{Reason: reason, GoAway: true}
+}
+
+// Request описывает полученный сервером запрос на отправку уведомления.
+type Request struct {
+	Token   string      // токен устройства из пути запроса
+	Header  http.Header // заголовки запроса
+	Payload []byte      // содержимое уведомления
+}
+
+// Server описывает сервер, имитирующий APNS.
+type Server struct {
+	URL       string           // адрес сервера, например https://127.0.0.1:2197
+	PublicKey *ecdsa.PublicKey // ключ для проверки подписи JWT
+	// JWTLifeTime задает время жизни JWT, после которого сервер отвечает
+	// ExpiredProviderToken.
+	JWTLifeTime time.Duration
+
+	listener    net.Listener
+	certificate *x509.Certificate
+	responses   map[string][]Response // ответы для токенов
+	requests    []*Request            // полученные запросы
+	conns       map[net.Conn]struct{} // открытые соединения
+	closed      bool
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+}
+
+// NewServer запускает сервер на указанном адресе. Если адрес пустой, то
+// используется случайный порт на 127.0.0.1. Если сертификат не указан, то
+// создается самоподписанный сертификат для 127.0.0.1 и localhost.
+func NewServer(addr string, cert *tls.Certificate) (*Server, error) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	if cert == nil {
+		var err error
+		if cert, err = generateCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var server = &Server{
+		URL:         "https://" + listener.Addr().String(),
+		JWTLifeTime: time.Hour,
+		listener:    listener,
+		certificate: leaf,
+		responses:   make(map[string][]Response),
+		conns:       make(map[net.Conn]struct{}),
+	}
+	server.wg.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// Close останавливает сервер и закрывает все открытые соединения.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Certificate возвращает сертификат сервера.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// CertificatePEM возвращает сертификат сервера в формате PEM.
+func (s *Server) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.certificate.Raw,
+	})
+}
+
+// Client возвращает HTTP/2 клиента, доверяющего сертификату сервера.
+func (s *Server) Client() *http.Client {
+	var pool = x509.NewCertPool()
+	pool.AddCert(s.certificate)
+	return &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		Timeout: 15 * time.Second,
+	}
+}
+
+// Respond задает ответы на запросы для токена устройства. Ответы выдаются по
+// очереди, последний повторяется для всех следующих запросов.
+func (s *Server) Respond(token string, responses ...Response) {
+	s.mu.Lock()
+	if len(responses) == 0 {
+		delete(s.responses, token)
+	} else {
+		s.responses[token] = responses
+	}
+	s.mu.Unlock()
+}
+
+// Requests возвращает список полученных сервером запросов.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	var list = make([]*Request, len(s.requests))
+	copy(list, s.requests)
+	s.mu.Unlock()
+	return list
+}
+
+// Reset удаляет заданные ответы и список полученных запросов.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.responses = make(map[string][]Response)
+	s.requests = nil
+	s.mu.Unlock()
+}
+
+// response возвращает очередной ответ для токена.
+func (s *Server) response(token string) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = s.responses[token]
+	if len(list) == 0 {
+		return OK
+	}
+	if len(list) > 1 {
+		s.responses[token] = list[1:]
+	}
+	return list[0]
+}
+
+// serve принимает входящие соединения.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// stream описывает состояние потока HTTP/2 до получения запроса целиком.
+type stream struct {
+	header http.Header
+	path   string
+	method string
+	body   bytes.Buffer
+}
+
+// serveConn обслуживает одно HTTP/2 соединение. Запросы обрабатываются
+// последовательно в порядке их получения.
+func (s *Server) serveConn(conn net.Conn) {
+	var preface = make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil ||
+		string(preface) != http2.ClientPreface {
+		return
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(); err != nil {
+		return
+	}
+	var streams = make(map[uint32]*stream)
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		var (
+			id  = frame.Header().StreamID
+			end bool // получен весь запрос
+		)
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				err = framer.WriteSettingsAck()
+			}
+		case *http2.PingFrame:
+			if !frame.IsAck() {
+				err = framer.WritePing(true, frame.Data)
+			}
+		case *http2.MetaHeadersFrame:
+			var st = &stream{header: make(http.Header)}
+			for _, field := range frame.Fields {
+				switch field.Name {
+				case ":path":
+					st.path = field.Value
+				case ":method":
+					st.method = field.Value
+				default:
+					if !strings.HasPrefix(field.Name, ":") {
+						st.header.Add(field.Name, field.Value)
+					}
+				}
+			}
+			streams[id] = st
+			end = frame.StreamEnded()
+		case *http2.DataFrame:
+			st, ok := streams[id]
+			if !ok {
+				continue
+			}
+			st.body.Write(frame.Data())
+			// возвращаем окно для приема данных
+			if size := uint32(len(frame.Data())); size > 0 {
+				if err = framer.WriteWindowUpdate(0, size); err == nil {
+					err = framer.WriteWindowUpdate(id, size)
+				}
+			}
+			end = frame.StreamEnded()
+		case *http2.RSTStreamFrame:
+			delete(streams, id)
+		case *http2.GoAwayFrame:
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !end {
+			continue
+		}
+		st := streams[id]
+		delete(streams, id)
+		if !s.handle(framer, id, st) {
+			return
+		}
+	}
+}
+
+// handle обрабатывает запрос и отправляет ответ. Возвращает false, если
+// соединение должно быть закрыто.
+func (s *Server) handle(framer *http2.Framer, id uint32, st *stream) bool {
+	var response = OK
+	var token string
+	switch {
+	case st.method != http.MethodPost:
+		response = Response{Status: http.StatusMethodNotAllowed,
+			Reason: "MethodNotAllowed"}
+	case !strings.HasPrefix(st.path, "/3/device/"):
+		response = Response{Status: http.StatusNotFound, Reason: "BadPath"}
+	default:
+		token = strings.TrimPrefix(st.path, "/3/device/")
+		s.mu.Lock()
+		s.requests = append(s.requests, &Request{
+			Token:   token,
+			Header:  st.header,
+			Payload: st.body.Bytes(),
+		})
+		s.mu.Unlock()
+		if reason := s.checkJWT(st.header.Get("authorization")); reason != "" {
+			response = Response{Status: http.StatusForbidden, Reason: reason}
+		} else if token == "" {
+			response = Response{Status: http.StatusBadRequest,
+				Reason: "MissingDeviceToken"}
+		} else if st.header.Get("apns-topic") == "" {
+			response = Response{Status: http.StatusBadRequest,
+				Reason: "MissingTopic"}
+		} else if st.body.Len() == 0 {
+			response = Response{Status: http.StatusBadRequest,
+				Reason: "PayloadEmpty"}
+		} else {
+			response = s.response(token)
+		}
+	}
+	if response.Wait != nil {
+		<-response.Wait
+	}
+	// закрываем соединение с указанием причины
+	if response.GoAway {
+		data, _ := json.Marshal(map[string]string{"reason": response.Reason})
+		framer.WriteGoAway(id, http2.ErrCodeNo, data)
+		return false
+	}
+	if response.Status == 0 {
+		response.Status = http.StatusOK
+	}
+	var apnsID = st.header.Get("apns-id")
+	if apnsID == "" {
+		apnsID = newID()
+	}
+	var body []byte
+	if response.Status != http.StatusOK {
+		var reason = map[string]interface{}{"reason": response.Reason}
+		if response.Timestamp != 0 {
+			reason["timestamp"] = response.Timestamp
+		}
+		body, _ = json.Marshal(reason)
+	}
+	var headers bytes.Buffer
+	encoder := hpack.NewEncoder(&headers)
+	encoder.WriteField(hpack.HeaderField{Name: ":status",
+		Value: strconv.Itoa(response.Status)})
+	encoder.WriteField(hpack.HeaderField{Name: "apns-id", Value: apnsID})
+	encoder.WriteField(hpack.HeaderField{Name: "date",
+		Value: time.Now().UTC().Format(http.TimeFormat)})
+	if len(body) > 0 {
+		encoder.WriteField(hpack.HeaderField{Name: "content-type",
+			Value: "application/json"})
+	}
+	err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: headers.Bytes(),
+		EndHeaders:    true,
+		EndStream:     len(body) == 0,
+	})
+	if err == nil && len(body) > 0 {
+		err = framer.WriteData(id, true, body)
+	}
+	return err == nil
+}
+
+// checkJWT проверяет токен авторизации провайдера и возвращает причину
+// ошибки APNS или пустую строку, если токен корректен.
+func (s *Server) checkJWT(authorization string) string {
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) ||
+		!strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "MissingProviderToken"
+	}
+	if s.PublicKey == nil {
+		return "" // подпись не проверяется
+	}
+	iat, err := verifyJWT(authorization[len(prefix):], s.PublicKey)
+	if err != nil {
+		return "InvalidProviderToken"
+	}
+	if time.Since(iat) > s.JWTLifeTime {
+		return "ExpiredProviderToken"
+	}
+	return ""
+}
+
+// errBadJWT возвращается для некорректного JWT.
+var errBadJWT = errors.New("bad jwt")
+
+// verifyJWT проверяет подпись ES256 токена и возвращает время его создания.
+func verifyJWT(token string, key *ecdsa.PublicKey) (time.Time, error) {
+	var parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errBadJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	for i, value := range []interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if err := json.Unmarshal(data, value); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if header.Alg != "ES256" || header.Kid == "" || claims.Iss == "" {
+		return time.Time{}, errBadJWT
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(sign) != 64 {
+		return time.Time{}, errBadJWT
+	}
+	var (
+		r   = new(big.Int).SetBytes(sign[:32])
+		s   = new(big.Int).SetBytes(sign[32:])
+		sum = sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	)
+	if !ecdsa.Verify(key, sum[:], r, s) {
+		return time.Time{}, errBadJWT
+	}
+	return time.Unix(claims.Iat, 0), nil
+}
+
+// newID возвращает случайный идентификатор уведомления в формате UUID.
+func newID() string {
+	var id = make([]byte, 16)
+	rand.Read(id)
+	var s = hex.EncodeToString(id)
+	return strings.ToUpper(s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" +
+		s[16:20] + "-" + s[20:])
+}
+
+// generateCertificate создает самоподписанный сертификат для 127.0.0.1,
+// ::1 и localhost.
+func generateCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Mock APNS"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
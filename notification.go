@@ -6,43 +6,207 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Notification описывает структуру push-уведомления.
 type Notification struct {
-	Token       string
-	ID          string
-	Expiration  time.Time
-	LowPriority bool
-	Topic       string
-	CollapseID  string
-	Payload     interface{}
-	Sandbox     bool
+	Token       string      `json:"token,omitempty"`
+	ID          string      `json:"id,omitempty"`
+	Expiration  time.Time   `json:"expiration,omitempty"`
+	LowPriority bool        `json:"lowPriority,omitempty"`
+	Topic       string      `json:"topic,omitempty"`
+	CollapseID  string      `json:"collapseId,omitempty"`
+	Payload     interface{} `json:"payload,omitempty"`
+	Sandbox     bool        `json:"sandbox,omitempty"`
+	PushType    string      `json:"pushType,omitempty"`
+	Truncate    bool        `json:"truncate,omitempty"`
+	History     string      `json:"history,omitempty"` // уведомление в истории
+	Host        string      `json:"-"`                 // адрес сервера APNS
 }
 
-// request возвращает сформированный запрос для отправки push-уведомления.
-func (n *Notification) Request() (req *http.Request, err error) {
-	var payload []byte
+// Типы push-уведомлений для заголовка apns-push-type.
+const (
+	PushAlert        = "alert"
+	PushBackground   = "background"
+	PushVoIP         = "voip"
+	PushComplication = "complication"
+	PushFileProvider = "fileprovider"
+	PushMDM          = "mdm"
+	PushLocation     = "location"
+	PushLiveActivity = "liveactivity"
+	PushToTalk       = "pushtotalk"
+)
+
+// pushTypeTopics содержит суффиксы, которые добавляются к теме для
+// уведомлений соответствующего типа. Типы без суффикса используют тему как
+// есть.
+var pushTypeTopics = map[string]string{
+	PushAlert:        "",
+	PushBackground:   "",
+	PushVoIP:         ".voip",
+	PushComplication: ".complication",
+	PushFileProvider: ".pushkit.fileprovider",
+	PushMDM:          "",
+	PushLocation:     ".location-query",
+	PushLiveActivity: ".push-type.liveactivity",
+	PushToTalk:       ".voip-ptt",
+}
+
+// payload возвращает содержимое уведомления в формате JSON.
+func (n *Notification) payload() ([]byte, error) {
 	switch data := n.Payload.(type) {
 	case []byte:
-		payload = data
+		return data, nil
 	case string:
-		payload = []byte(data)
+		return []byte(data), nil
 	case json.RawMessage:
-		payload = []byte(data)
+		return []byte(data), nil
 	default:
-		payload, err = json.Marshal(n.Payload)
-		if err != nil {
-			return nil, err
+		return json.Marshal(n.Payload)
+	}
+}
+
+// apsPayload описывает поля содержимого уведомления, используемые для
+// определения и проверки типа уведомления.
+type apsPayload struct {
+	APS map[string]json.RawMessage `json:"aps"`
+	MDM json.RawMessage            `json:"mdm"`
+}
+
+// has возвращает true, если в словаре aps задан хотя бы один из ключей.
+func (p *apsPayload) has(keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := p.APS[key]; ok {
+			return true
 		}
 	}
-	var host = "https://api.push.apple.com"
-	if n.Sandbox {
-		host = "https://api.development.push.apple.com"
+	return false
+}
+
+// contentAvailable возвращает true, если в словаре aps задан
+// content-available со значением 1.
+func (p *apsPayload) contentAvailable() bool {
+	var value int
+	return json.Unmarshal(p.APS["content-available"], &value) == nil &&
+		value == 1
+}
+
+// PayloadError описывает ошибку содержимого или параметров уведомления.
+type PayloadError string
+
+func (e PayloadError) Error() string { return string(e) }
+
+// prepare возвращает содержимое уведомления в формате JSON и его тип. Если
+// тип не указан явно, то он определяется по содержимому: background для
+// уведомлений, содержащих только content-available, иначе alert. Содержимое
+// проверяется на соответствие правилам для этого типа и на допустимый размер.
+// Если задан флаг Truncate, то слишком длинный текст уведомления сокращается.
+func (n *Notification) prepare() (payload []byte, pushType string, err error) {
+	payload, err = n.payload()
+	if err != nil {
+		return nil, "", err
+	}
+	var aps = new(apsPayload)
+	if err = json.Unmarshal(payload, aps); err != nil {
+		return nil, "", PayloadError("payload is not a JSON object")
+	}
+	pushType = n.PushType
+	if pushType == "" {
+		pushType = PushAlert
+		if aps.contentAvailable() && !aps.has("alert", "badge", "sound") {
+			pushType = PushBackground
+		}
+	}
+	if _, ok := pushTypeTopics[pushType]; !ok {
+		return nil, "", PayloadError(
+			fmt.Sprintf("unsupported push type %q", pushType))
+	}
+	switch pushType {
+	case PushAlert:
+		if !aps.has("alert", "badge", "sound") {
+			return nil, "", PayloadError(
+				"alert push requires aps alert, badge or sound")
+		}
+	case PushBackground:
+		if !aps.contentAvailable() {
+			return nil, "", PayloadError(
+				"background push requires aps content-available 1")
+		}
+		if aps.has("alert", "badge", "sound") {
+			return nil, "", PayloadError(
+				"background push must not contain aps alert, badge or sound")
+		}
+	case PushMDM:
+		if len(aps.MDM) == 0 {
+			return nil, "", PayloadError("mdm push requires mdm key")
+		}
+	case PushLiveActivity:
+		var event string
+		json.Unmarshal(aps.APS["event"], &event)
+		switch event {
+		case "start":
+			if !aps.has("attributes-type") || !aps.has("attributes") {
+				return nil, "", PayloadError(
+					"live activity start requires aps attributes-type and attributes")
+			}
+			fallthrough
+		case "update":
+			if !aps.has("content-state") {
+				return nil, "", PayloadError(
+					"live activity " + event + " requires aps content-state")
+			}
+		case "end":
+		default:
+			return nil, "", PayloadError(
+				"live activity push requires aps event start, update or end")
+		}
+		if !aps.has("timestamp") {
+			return nil, "", PayloadError("live activity push requires aps timestamp")
+		}
+	case PushLocation, PushToTalk:
+		if n.LowPriority {
+			return nil, "", PayloadError(
+				pushType + " push must be sent with high priority")
+		}
+	}
+	// проверяем размер и при необходимости сокращаем текст уведомления
+	if limit := maxPayloadSize(pushType); len(payload) > limit {
+		if !n.Truncate {
+			return nil, "", &PayloadTooLargeError{Size: len(payload), Limit: limit}
+		}
+		if payload, err = truncatePayload(payload, limit); err != nil {
+			return nil, "", err
+		}
+	}
+	return payload, pushType, nil
+}
+
+// Validate проверяет содержимое уведомления на соответствие его типу.
+func (n *Notification) Validate() error {
+	_, _, err := n.prepare()
+	return err
+}
+
+// topic возвращает тему уведомления с суффиксом, соответствующим его типу.
+func (n *Notification) topic(pushType string) string {
+	var suffix = pushTypeTopics[pushType]
+	if n.Topic == "" || suffix == "" || strings.HasSuffix(n.Topic, suffix) {
+		return n.Topic
+	}
+	return n.Topic + suffix
+}
+
+// Request возвращает сформированный запрос для отправки push-уведомления.
+func (n *Notification) Request() (req *http.Request, err error) {
+	payload, pushType, err := n.prepare()
+	if err != nil {
+		return nil, err
 	}
 	req, err = http.NewRequest(http.MethodPost,
-		fmt.Sprintf("%s/3/device/%s", host, n.Token), bytes.NewReader(payload))
+		fmt.Sprintf("%s/3/device/%s", n.host(), n.Token),
+		bytes.NewReader(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -58,14 +222,33 @@ func (n *Notification) Request() (req *http.Request, err error) {
 		}
 		req.Header.Set("apns-expiration", exp)
 	}
-	if n.LowPriority {
+	req.Header.Set("apns-push-type", pushType)
+	// фоновые уведомления должны отправляться только с низким приоритетом
+	if n.LowPriority || pushType == PushBackground {
 		req.Header.Set("apns-priority", "5")
 	}
-	if n.Topic != "" {
-		req.Header.Set("apns-topic", n.Topic)
+	if topic := n.topic(pushType); topic != "" {
+		req.Header.Set("apns-topic", topic)
 	}
 	if n.CollapseID != "" && len(n.CollapseID) <= 64 {
 		req.Header.Set("apns-collapse-id", n.CollapseID)
 	}
 	return req, nil
 }
+
+// host возвращает адрес сервера APNS для отправки уведомления. Если он не
+// задан явно, то используется сервер Apple для соответствующего окружения.
+func (n *Notification) host() string {
+	if n.Host != "" {
+		return strings.TrimSuffix(n.Host, "/")
+	}
+	return apnsHost(n.Sandbox)
+}
+
+// apnsHost возвращает адрес сервера APNS в зависимости от окружения.
+func apnsHost(sandbox bool) string {
+	if sandbox {
+		return "https://api.development.push.apple.com"
+	}
+	return "https://api.push.apple.com"
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mdigger/rest"
+)
+
+// openAPISpec содержит описание API сервиса в формате OpenAPI 3.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiSchema описывает схему данных из описания API. Поддерживается только то
+// подмножество JSON Schema, которое используется в openapi.json.
+type apiSchema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Format               string                `json:"format"`
+	Enum                 []interface{}         `json:"enum"`
+	Pattern              string                `json:"pattern"`
+	MinLength            int                   `json:"minLength"`
+	Minimum              *float64              `json:"minimum"`
+	Maximum              *float64              `json:"maximum"`
+	Required             []string              `json:"required"`
+	Properties           map[string]*apiSchema `json:"properties"`
+	AdditionalProperties *apiSchema            `json:"additionalProperties"`
+	Items                *apiSchema            `json:"items"`
+	AllOf                []*apiSchema          `json:"allOf"`
+	OneOf                []*apiSchema          `json:"oneOf"`
+}
+
+// apiSpec описывает разобранное описание API: пути с операциями и схемы
+// данных.
+type apiSpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*apiSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+// openAPI содержит разобранное описание API сервиса.
+var openAPI = parseAPISpec(openAPISpec)
+
+// parseAPISpec разбирает описание API. Описание встроено в приложение,
+// поэтому ошибка в нем приводит к панике при запуске.
+func parseAPISpec(data []byte) *apiSpec {
+	var spec = new(apiSpec)
+	if err := json.Unmarshal(data, spec); err != nil {
+		panic(fmt.Sprintf("bad openapi.json: %v", err))
+	}
+	return spec
+}
+
+// Routes возвращает описанные операции в виде "METHOD /path" с параметрами
+// пути в формате мультиплексора запросов.
+func (s *apiSpec) Routes() []string {
+	var routes []string
+	for path, item := range s.Paths {
+		path = apiPathParam.ReplaceAllString(path, ":$1")
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			routes = append(routes, strings.ToUpper(method)+" "+path)
+		}
+	}
+	return routes
+}
+
+// apiPathParam выделяет параметры пути в описании API.
+var apiPathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// schema возвращает схему данных, на которую ссылается $ref.
+func (s *apiSpec) schema(schema *apiSchema) *apiSchema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref,
+			"#/components/schemas/")]
+	}
+	return schema
+}
+
+// fieldError описывает ошибку в значении поля тела запроса.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError описывает поля тела запроса, не соответствующие описанию
+// API.
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	var list = make([]string, len(e))
+	for i, field := range e {
+		list[i] = field.Field + ": " + field.Message
+	}
+	return "invalid request: " + strings.Join(list, "; ")
+}
+
+// Validate проверяет данные на соответствие схеме с указанным именем.
+func (s *apiSpec) Validate(name string, value interface{}) validationError {
+	var errs validationError
+	s.validate(s.Components.Schemas[name], value, "", &errs)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Field < errs[j].Field
+	})
+	return errs
+}
+
+// validate проверяет значение поля на соответствие схеме и добавляет
+// найденные ошибки. Значение null не проверяется, как и при разборе запроса.
+func (s *apiSpec) validate(schema *apiSchema, value interface{}, field string,
+	errs *validationError) {
+	schema = s.schema(schema)
+	if schema == nil || value == nil {
+		return
+	}
+	// fail добавляет ошибку значения поля
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, fieldError{
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	for _, schema := range schema.AllOf {
+		s.validate(schema, value, field, errs)
+	}
+	if len(schema.OneOf) > 0 {
+		var types []string
+		for _, schema := range schema.OneOf {
+			var errs validationError
+			if s.validate(schema, value, field, &errs); len(errs) == 0 {
+				types = nil
+				break
+			}
+			types = append(types, s.schema(schema).Type)
+		}
+		if len(types) > 0 {
+			fail("must be %s", strings.Join(types, " or "))
+		}
+	}
+	if schema.Type != "" && !apiType(schema.Type, value) {
+		fail("must be %s", schema.Type)
+		return
+	}
+	if len(schema.Enum) > 0 && !apiEnum(schema.Enum, value) {
+		var list = make([]string, len(schema.Enum))
+		for i, item := range schema.Enum {
+			list[i] = fmt.Sprintf("%q", fmt.Sprint(item))
+		}
+		fail("must be one of %s", strings.Join(list, ", "))
+	}
+	switch value := value.(type) {
+	case string:
+		if utf8.RuneCountInString(value) < schema.MinLength {
+			fail("must not be empty")
+		}
+		if schema.Pattern != "" {
+			if ok, _ := regexp.MatchString(schema.Pattern, value); !ok {
+				fail("bad format")
+			}
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				fail("must be RFC 3339 date and time")
+			}
+		}
+	case json.Number:
+		number, _ := value.Float64()
+		if schema.Minimum != nil && number < *schema.Minimum {
+			fail("must be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			fail("must be at most %v", *schema.Maximum)
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if value[name] == nil {
+				*errs = append(*errs, fieldError{
+					Field:   apiField(field, name),
+					Message: "required",
+				})
+			}
+		}
+		for name, item := range value {
+			property, ok := schema.Properties[name]
+			if !ok {
+				property = schema.AdditionalProperties
+			}
+			s.validate(property, item, apiField(field, name), errs)
+		}
+	case []interface{}:
+		for i, item := range value {
+			s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	}
+}
+
+// apiField возвращает путь к вложенному полю.
+func apiField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// apiType возвращает true, если значение соответствует типу из схемы.
+func apiType(name string, value interface{}) bool {
+	switch value := value.(type) {
+	case string:
+		return name == "string"
+	case bool:
+		return name == "boolean"
+	case json.Number:
+		if name == "integer" {
+			_, err := value.Int64()
+			return err == nil
+		}
+		return name == "number"
+	case map[string]interface{}:
+		return name == "object"
+	case []interface{}:
+		return name == "array"
+	default:
+		return false
+	}
+}
+
+// apiEnum возвращает true, если значение есть в списке допустимых.
+func apiEnum(enum []interface{}, value interface{}) bool {
+	if number, ok := value.(json.Number); ok {
+		value, _ = number.Float64()
+	}
+	for _, item := range enum {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBody проверяет тело запроса в формате JSON на соответствие схеме
+// из описания API. Тела в других форматах и некорректный JSON оставляются для
+// разбора обработчиком. Клиентам API 1.2 возвращается validationError со
+// списком полей, остальным — ошибка запроса с тем же описанием.
+func validateBody(c *rest.Context, schema string) error {
+	if c.Request.Body == nil || !strings.HasPrefix(
+		c.Request.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+	var value interface{}
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil
+	}
+	errs := openAPI.Validate(schema, value)
+	switch {
+	case len(errs) == 0:
+		return nil
+	case isAPIVersion(c.Request, apiVersion):
+		return errs
+	default:
+		return c.Error(http.StatusBadRequest, errs.Error())
+	}
+}
+
+// OpenAPI отдает описание API сервиса в формате OpenAPI 3.
+func (s *Service) OpenAPI(c *rest.Context) error {
+	c.SetHeader("Content-Type", "application/json; charset=utf-8")
+	c.Response.WriteHeader(http.StatusOK)
+	_, err := c.Response.Write(openAPISpec)
+	return err
+}
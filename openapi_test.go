@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIRoutes проверяет, что описание API содержит все обработчики
+// запросов сервиса и не содержит лишних.
+func TestOpenAPIRoutes(t *testing.T) {
+	ts := newTestService(t)
+	var described = make(map[string]bool)
+	for _, route := range openAPI.Routes() {
+		described[route] = true
+	}
+	for _, route := range ts.service.routes {
+		if !described[route] {
+			t.Errorf("%s: not described in openapi.json", route)
+		}
+		delete(described, route)
+	}
+	for route := range described {
+		t.Errorf("%s: described in openapi.json, but not registered", route)
+	}
+	// описание отдается сервисом
+	status, resp := ts.request("GET", "/openapi.json", nil)
+	if status != http.StatusOK || resp.header.Get("Content-Type") !=
+		"application/json; charset=utf-8" {
+		t.Errorf("openapi.json: %d, %v", status, resp.header)
+	}
+}
+
+// jsonFields возвращает имена полей структуры в JSON, включая поля
+// встроенных структур.
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// schemaFields возвращает имена свойств схемы, включая свойства схем allOf.
+func schemaFields(schema *apiSchema) []string {
+	schema = openAPI.schema(schema)
+	var fields []string
+	for name := range schema.Properties {
+		fields = append(fields, name)
+	}
+	for _, schema := range schema.AllOf {
+		fields = append(fields, schemaFields(schema)...)
+	}
+	return fields
+}
+
+// TestOpenAPISchemas проверяет, что схемы тел запросов описывают все поля
+// структур, в которые эти запросы разбираются.
+func TestOpenAPISchemas(t *testing.T) {
+	for name, value := range map[string]interface{}{
+		"TokenRequest":     tokenRequest{},
+		"PushRequest":      pushRequest{},
+		"TopicPushRequest": topicPushRequest{},
+		"BroadcastRequest": broadcastRequest{},
+		"Alert":            Alert{},
+		"Audience":         Audience{},
+		"ActivityRequest":  activityRequest{},
+		"Tags":             tagsRequest{},
+		"UserProfile":      UserProfile{},
+		"QuietHours":       QuietHours{},
+		"HistoryRead":      historyRead{},
+		"Template":         Template{},
+		"TemplateVariant":  TemplateVariant{},
+	} {
+		schema := openAPI.Components.Schemas[name]
+		if schema == nil {
+			t.Errorf("%s: schema not described", name)
+			continue
+		}
+		want := jsonFields(reflect.TypeOf(value))
+		got := schemaFields(schema)
+		sort.Strings(want)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: schema fields %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestValidateBody(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	// post отправляет запрос с указанной версией API и возвращает код ответа и
+	// описание ошибки
+	post := func(version, path string, body interface{}) (int, *apiError) {
+		t.Helper()
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", ts.server.URL+path,
+			bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("X-API-Version", version)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Error *apiError `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Error
+	}
+	var push = map[string]interface{}{
+		"payload":    map[string]interface{}{"aps": map[string]interface{}{"alert": "Test"}},
+		"expiration": "tomorrow",
+		"pushType":   "unknown",
+		"alert":      map[string]interface{}{"sound": 1, "badge": 1.5},
+		"users":      []interface{}{"dmitrys", 42},
+	}
+	status, apierr := post("1.2", "/apns/"+testTopic+"/push", push)
+	if status != http.StatusBadRequest || apierr == nil {
+		t.Fatalf("push: %d, %+v", status, apierr)
+	}
+	var fields []string
+	for _, field := range apierr.Fields {
+		fields = append(fields, field.Field)
+	}
+	if want := []string{"alert.badge", "alert.sound", "expiration", "pushType",
+		"users[1]"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("push fields: %+v", apierr.Fields)
+	}
+	// прежние клиенты получают ошибку запроса
+	if status, _ := post("1.1", "/apns/"+testTopic+"/push", push); status != http.StatusBadRequest {
+		t.Errorf("push version 1.1: %d", status)
+	}
+	status, apierr = post("1.2", "/apns/"+testTopic+"/users/dmitrys",
+		map[string]interface{}{"kind": "sms"})
+	if status != http.StatusBadRequest || apierr == nil || len(apierr.Fields) != 2 ||
+		apierr.Fields[0] != (fieldError{"kind", `must be one of "", "device", "voip"`}) ||
+		apierr.Fields[1] != (fieldError{"token", "required"}) {
+		t.Errorf("token: %d, %+v", status, apierr)
+	}
+	// запросы Live Activity проверяются так же
+	ts.expect(http.StatusCreated, "POST", "/apns/"+testTopic+"/users/dmitrys/pushtostart",
+		map[string]string{"token": "BBBB"})
+	ts.expect(http.StatusCreated, "POST", "/apns/"+testTopic+"/users/dmitrys/activities/match",
+		map[string]string{"token": "CCCC"})
+	status, apierr = post("1.2", "/apns/"+testTopic+"/users/dmitrys/activities",
+		map[string]interface{}{"attributesType": "Match", "relevanceScore": "high"})
+	if status != http.StatusBadRequest || apierr == nil || len(apierr.Fields) != 1 ||
+		apierr.Fields[0].Field != "relevanceScore" {
+		t.Errorf("start activity: %d, %+v", status, apierr)
+	}
+	ts.expect(http.StatusBadRequest, "PUT", "/apns/"+testTopic+"/users/dmitrys/activities/match",
+		map[string]interface{}{"contentState": "live"})
+	if n := len(ts.apns.Requests()); n != 0 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// корректные запросы не затрагиваются
+	if status, apierr := post("1.2", "/apns/"+testTopic+"/users/dmitrys/push",
+		map[string]interface{}{
+			"payload":    map[string]interface{}{"aps": map[string]interface{}{"alert": "Test"}},
+			"expiration": "2030-01-01T00:00:00Z",
+			"alert": map[string]interface{}{
+				"sound": map[string]interface{}{
+					"critical": 1, "name": "alarm.caf", "volume": 0.5,
+				},
+			},
+		}); status != http.StatusOK {
+		t.Errorf("valid push: %d, %+v", status, apierr)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Максимальный размер содержимого уведомления, принимаемый APNS.
+const (
+	MaxPayloadSize     = 4096 // обычные уведомления
+	MaxVoIPPayloadSize = 5120 // VoIP-уведомления
+)
+
+// maxPayloadSize возвращает максимальный размер содержимого уведомления для
+// указанного типа.
+func maxPayloadSize(pushType string) int {
+	if pushType == PushVoIP {
+		return MaxVoIPPayloadSize
+	}
+	return MaxPayloadSize
+}
+
+// PayloadTooLargeError возвращается, если размер содержимого уведомления
+// превышает допустимый.
+type PayloadTooLargeError struct {
+	Size  int // размер содержимого в байтах
+	Limit int // максимальный допустимый размер
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("payload size %d bytes exceeds the limit of %d bytes",
+		e.Size, e.Limit)
+}
+
+// ellipsis добавляется в конец сокращенного текста уведомления.
+const ellipsis = "…"
+
+// truncatePayload сокращает текст уведомления (aps.alert или aps.alert.body)
+// так, чтобы размер содержимого не превышал limit. Текст обрезается по
+// границе символа UTF-8 и дополняется многоточием. Если сократить текст
+// недостаточно, то возвращается ошибка PayloadTooLargeError.
+func truncatePayload(payload []byte, limit int) ([]byte, error) {
+	var tooLarge = &PayloadTooLargeError{Size: len(payload), Limit: limit}
+	var data map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber() // сохраняем числа как есть
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	aps, _ := data["aps"].(map[string]interface{})
+	if aps == nil {
+		return nil, tooLarge
+	}
+	// находим текст уведомления и функцию для его замены
+	var (
+		body string
+		set  func(string)
+	)
+	switch alert := aps["alert"].(type) {
+	case string:
+		body, set = alert, func(text string) { aps["alert"] = text }
+	case map[string]interface{}:
+		text, ok := alert["body"].(string)
+		if !ok {
+			return nil, tooLarge
+		}
+		body, set = text, func(text string) { alert["body"] = text }
+	default:
+		return nil, tooLarge
+	}
+	// encode возвращает содержимое с текстом из первых n символов
+	var runes = []rune(body)
+	encode := func(n int) ([]byte, error) {
+		set(string(runes[:n]) + ellipsis)
+		return json.Marshal(data)
+	}
+	// ищем максимальную длину текста, при которой содержимое помещается
+	var (
+		low, high = 0, len(runes) - 1
+		result    []byte
+	)
+	for low <= high {
+		var middle = (low + high) / 2
+		encoded, err := encode(middle)
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) <= limit {
+			result = encoded
+			low = middle + 1
+		} else {
+			high = middle - 1
+		}
+	}
+	if result == nil || !utf8.Valid(result) {
+		return nil, tooLarge
+	}
+	return result, nil
+}
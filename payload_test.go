@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// alertText возвращает текст уведомления: aps.alert или aps.alert.body.
+func alertText(t *testing.T, payload []byte) string {
+	t.Helper()
+	var data struct {
+		Aps struct {
+			Alert json.RawMessage `json:"alert"`
+		} `json:"aps"`
+	}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		t.Fatalf("bad payload %s: %v", payload, err)
+	}
+	var text string
+	if json.Unmarshal(data.Aps.Alert, &text) == nil {
+		return text
+	}
+	var alert struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(data.Aps.Alert, &alert); err != nil {
+		t.Fatalf("bad alert %s: %v", data.Aps.Alert, err)
+	}
+	return alert.Body
+}
+
+func TestTruncatePayload(t *testing.T) {
+	for name, test := range map[string]struct {
+		text  string // повторяемый фрагмент текста
+		alert bool   // текст в aps.alert.body
+		limit int
+	}{
+		"ascii":        {"x", false, MaxPayloadSize},
+		"cyrillic":     {"привет", false, MaxPayloadSize},
+		"emoji":        {"👍🏻", true, MaxPayloadSize},
+		"mixed":        {"a€😀", true, MaxPayloadSize},
+		"voip":         {"é", true, MaxVoIPPayloadSize},
+		"odd boundary": {"ж", false, 101},
+	} {
+		var text = strings.Repeat(test.text, test.limit)
+		var aps = map[string]interface{}{"alert": text, "badge": 1}
+		if test.alert {
+			aps["alert"] = map[string]interface{}{"title": "Title", "body": text}
+		}
+		payload, err := json.Marshal(map[string]interface{}{"aps": aps, "id": 42})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := truncatePayload(payload, test.limit)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(result) > test.limit || !utf8.Valid(result) {
+			t.Errorf("%s: size %d, valid %v", name, len(result), utf8.Valid(result))
+			continue
+		}
+		// текст обрезан по границе символа и дополнен многоточием
+		truncated := alertText(t, result)
+		if !strings.HasSuffix(truncated, ellipsis) ||
+			!strings.HasPrefix(text, strings.TrimSuffix(truncated, ellipsis)) {
+			t.Errorf("%s: truncated text %q", name, truncated)
+			continue
+		}
+		// еще один символ текста уже не помещается
+		var n = utf8.RuneCountInString(truncated) // с учетом многоточия
+		var longer = string([]rune(text)[:n]) + ellipsis
+		if test.alert {
+			aps["alert"].(map[string]interface{})["body"] = longer
+		} else {
+			aps["alert"] = longer
+		}
+		if data, _ := json.Marshal(map[string]interface{}{"aps": aps, "id": 42}); len(data) <= test.limit {
+			t.Errorf("%s: text truncated too much: %d bytes", name, len(result))
+		}
+		// остальные поля сохраняются
+		if !strings.Contains(string(result), `"badge":1`) ||
+			!strings.Contains(string(result), `"id":42`) {
+			t.Errorf("%s: payload %s", name, result)
+		}
+	}
+	// содержимое без текста сократить нельзя
+	payload, _ := json.Marshal(map[string]interface{}{
+		"aps":  map[string]interface{}{"badge": 1},
+		"data": strings.Repeat("x", MaxPayloadSize),
+	})
+	if _, err := truncatePayload(payload, MaxPayloadSize); err == nil {
+		t.Error("payload without text truncated")
+	} else if err, ok := err.(*PayloadTooLargeError); !ok ||
+		err.Size != len(payload) || err.Limit != MaxPayloadSize {
+		t.Errorf("payload without text: %v", err)
+	}
+}
+
+func TestNotificationTruncate(t *testing.T) {
+	// размер между ограничениями для обычных и VoIP-уведомлений
+	var text = strings.Repeat("ü", (MaxPayloadSize+MaxVoIPPayloadSize)/4)
+	var n = Notification{
+		Payload: map[string]interface{}{
+			"aps": map[string]interface{}{"alert": text},
+		},
+		Truncate: true,
+	}
+	payload, pushType, err := n.prepare()
+	if err != nil || pushType != PushAlert || len(payload) > MaxPayloadSize ||
+		alertText(t, payload) == text {
+		t.Errorf("alert: %d bytes, %v", len(payload), err)
+	}
+	n.PushType = PushVoIP
+	if payload, _, err = n.prepare(); err != nil || alertText(t, payload) != text ||
+		len(payload) <= MaxPayloadSize {
+		t.Errorf("voip: %d bytes, %v", len(payload), err)
+	}
+	n.Payload = map[string]interface{}{
+		"aps": map[string]interface{}{"alert": text + text},
+	}
+	if payload, _, err = n.prepare(); err != nil || len(payload) > MaxVoIPPayloadSize ||
+		len(payload) <= MaxPayloadSize {
+		t.Errorf("truncated voip: %d bytes, %v", len(payload), err)
+	}
+	// без разрешения сокращать возвращается ошибка
+	n.Truncate = false
+	if _, _, err = n.prepare(); err == nil {
+		t.Error("voip payload too large")
+	} else if err, ok := err.(*PayloadTooLargeError); !ok || err.Limit != MaxVoIPPayloadSize {
+		t.Errorf("voip payload too large: %v", err)
+	}
+}
+
+func TestPushTruncate(t *testing.T) {
+	ts := newTestService(t)
+	ts.addTokens("dmitrys", false, "AAAA")
+	var text = strings.Repeat("я", MaxPayloadSize)
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		map[string]interface{}{
+			"alert":    map[string]interface{}{"title": "Title", "body": text},
+			"truncate": true,
+		})
+	requests := ts.apns.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("apns requests: %d", len(requests))
+	}
+	if payload := requests[0].Payload; len(payload) > MaxPayloadSize ||
+		!strings.HasSuffix(alertText(t, payload), ellipsis) {
+		t.Errorf("payload: %d bytes", len(payload))
+	}
+}
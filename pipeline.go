@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// defaultWorkers задает количество параллельных отправок по умолчанию.
+const defaultWorkers = 8
+
+// PushResult описывает результат отправки уведомления на один токен.
+type PushResult struct {
+	Token  string // токен устройства
+	Status string // статус отправки
+	Err    error  // ошибка, после которой отправка невозможна
+}
+
+// PushStream отправляет уведомление на все токены из канала tokens, используя
+// workers параллельных обработчиков, и возвращает канал с результатами. Частота
+// отправки ограничивается limiter. Отправка прекращается при закрытии канала
+// tokens или stop; канал с результатами закрывается после завершения всех
+// обработчиков.
+func (c *Config) PushStream(notification Notification, tokens <-chan string,
+	workers int, limiter *Limiter, stop <-chan struct{}) <-chan PushResult {
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	var (
+		results = make(chan PushResult, workers)
+		wg      sync.WaitGroup
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for token := range tokens {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !limiter.Wait(stop) {
+					return
+				}
+				status, err := c.pushToken(notification, token)
+				results <- PushResult{Token: token, Status: status, Err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
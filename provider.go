@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
@@ -9,7 +10,6 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -19,6 +19,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mdigger/log"
 	"golang.org/x/net/http2"
 )
 
@@ -28,6 +29,7 @@ type ProviderToken struct {
 	privateKey *ecdsa.PrivateKey // private key for sign
 	jwt        string            // cached JWT
 	created    time.Time         // cache creation time
+	skewWarned time.Time         // time of the last clock skew warning
 	mu         sync.RWMutex
 }
 
@@ -60,57 +62,147 @@ func NewProviderToken(teamID, keyID string, privateKeyData []byte) (*ProviderTok
 		return nil, err
 	}
 	privateKey, ok := private.(*ecdsa.PrivateKey)
-	if !ok {
+	if !ok || privateKey.Curve != elliptic.P256() {
 		return nil, ErrPTBadPrivateKey
 	}
 	jwt.privateKey = privateKey
 	return jwt, nil
 }
 
-// httpAPNSClient http.Client для отправки push-уведомлений.
-var httpAPNSClient = &http.Client{Timeout: 15 * time.Second}
+// httpAPNSClient http.Client для отправки push-уведомлений, если в
+// конфигурации не заданы свои доверенные сертификаты. Используется транспорт
+// HTTP/2 напрямую, чтобы получать описание ошибки из фрейма GOAWAY.
+var httpAPNSClient = &http.Client{
+	Transport: new(http2.Transport),
+	Timeout:   15 * time.Second,
+}
+
+// Push отправляет push-уведомление на сервер APNS с помощью client. Если
+// APNS отклонил JWT как устаревший или недействительный, то токен создается
+// заново и отправка повторяется один раз.
+func (pt *ProviderToken) Push(client *http.Client, notification Notification) (
+	id string, err error) {
+	id, token, err := pt.push(client, notification)
+	if apnserr, ok := err.(*Error); ok && apnserr.IsProviderToken() {
+		ctxlog := log.WithField("reason", apnserr.Reason)
+		if !pt.invalidate(token) {
+			ctxlog.Warning("provider token rejected, but was updated recently")
+			return id, err
+		}
+		ctxlog.Warning("provider token rejected: retry with a new token")
+		id, _, err = pt.push(client, notification)
+	}
+	return id, err
+}
 
-// Push отправляет push-уведомление на сервер APNS.
-func (pt *ProviderToken) Push(notification Notification) (id string, err error) {
+// push отправляет push-уведомление на сервер APNS и возвращает вместе с
+// результатом использованный для авторизации JWT.
+func (pt *ProviderToken) push(client *http.Client, notification Notification) (
+	id, token string, err error) {
 	// формируем запрос на отсылку push-уведомления
 	req, err := notification.Request()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	// запрашиваем и устанавливаем токен для авторизации APNS
-	token, err := pt.JWT()
+	token, err = pt.JWT()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	req.Header.Set("authorization", token)
 	// отсылаем запрос
-	resp, err := httpAPNSClient.Do(req)
-	if resp.Body != nil {
+	resp, err := client.Do(req)
+	if resp != nil && resp.Body != nil {
 		defer func() {
 			io.Copy(ioutil.Discard, resp.Body)
 			resp.Body.Close()
 		}()
 	}
 	// смотрим на ошибки обработки запроса
-	if err, ok := err.(*url.Error); ok {
-		if err, ok := err.Err.(http2.GoAwayError); ok {
-			return "", APNSError(0, strings.NewReader(err.DebugData))
-		}
+	if debug, ok := goAwayDebugData(err); ok {
+		return "", token, APNSError(0, strings.NewReader(debug))
 	}
 	if err != nil {
-		return "", err
+		return "", token, err
 	}
+	pt.checkClockSkew(resp.Header.Get("date"))
 	// разбираем ответ от APNS-сервиса
 	id = resp.Header.Get("apns-id")
 	if resp.StatusCode == http.StatusOK {
-		return id, nil
+		return id, token, nil
 	}
 	// возвращаем описание ошибки
-	return id, APNSError(resp.StatusCode, resp.Body)
+	return id, token, APNSError(resp.StatusCode, resp.Body)
+}
+
+// MaxClockSkew задает допустимое расхождение локальных часов с часами сервера
+// APNS. При большем расхождении APNS может считать JWT устаревшим.
+var MaxClockSkew = time.Minute
+
+// checkClockSkew сравнивает локальное время со временем из заголовка Date
+// ответа APNS и выводит предупреждение, если часы расходятся больше, чем на
+// MaxClockSkew. Предупреждение выводится не чаще, чем раз в JWTMinInterval.
+func (pt *ProviderToken) checkClockSkew(date string) {
+	if date == "" {
+		return
+	}
+	server, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	skew := time.Since(server)
+	// время в заголовке задано с точностью до секунды
+	if skew < MaxClockSkew+time.Second && skew > -MaxClockSkew-time.Second {
+		return
+	}
+	pt.mu.Lock()
+	warn := time.Since(pt.skewWarned) > JWTMinInterval
+	if warn {
+		pt.skewWarned = time.Now()
+	}
+	pt.mu.Unlock()
+	if warn {
+		log.WithFields(log.Fields{
+			"skew":   skew.Truncate(time.Second),
+			"server": server,
+		}).Warning("local clock differs from APNS server time")
+	}
+}
+
+// goAwayDebugData возвращает отладочные данные фрейма GOAWAY, если ошибка
+// вызвана закрытием соединения сервером. Новые версии Go передают работу
+// транспорта встроенной в net/http реализации HTTP/2, поэтому ошибка может
+// иметь другой тип с тем же описанием: в этом случае данные извлекаются из
+// текста ошибки.
+func goAwayDebugData(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	var goAway http2.GoAwayError
+	if errors.As(err, &goAway) {
+		return goAway.DebugData, true
+	}
+	if err, ok := err.(*url.Error); ok {
+		msg := err.Err.Error()
+		if !strings.Contains(msg, "server sent GOAWAY") {
+			return "", false
+		}
+		if i := strings.LastIndex(msg, "debug="); i >= 0 {
+			if debug, err := strconv.Unquote(msg[i+6:]); err == nil {
+				return debug, true
+			}
+		}
+	}
+	return "", false
 }
 
 var JWTLifeTime = time.Minute * 55
 
+// JWTMinInterval задает минимальный интервал между созданием новых JWT, если
+// APNS отклонил текущий. При более частой смене токена APNS отвечает
+// TooManyProviderTokenUpdates.
+var JWTMinInterval = time.Minute * 20
+
 func (pt *ProviderToken) JWT() (string, error) {
 	if pt == nil {
 		return "", ErrPTNotSet
@@ -119,47 +211,97 @@ func (pt *ProviderToken) JWT() (string, error) {
 	jwt := pt.jwt
 	created := pt.created
 	pt.mu.RUnlock()
-	if jwt == "" || time.Since(created) > JWTLifeTime {
-		return pt.createJWT()
+	if jwt != "" && time.Since(created) <= JWTLifeTime {
+		return jwt, nil
 	}
-	return jwt, nil
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	// токен мог быть уже создан параллельным запросом
+	if pt.jwt != "" && time.Since(pt.created) <= JWTLifeTime {
+		return pt.jwt, nil
+	}
+	return pt.createJWT()
+}
+
+// invalidate сбрасывает закешированный JWT, отклоненный APNS, чтобы при
+// следующем запросе был создан новый. Возвращает false, если токен создан
+// менее JWTMinInterval назад и не может быть заменен. Если токен уже был
+// заменен другим запросом, то возвращает true без сброса.
+func (pt *ProviderToken) invalidate(jwt string) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.jwt != jwt {
+		return true
+	}
+	if time.Since(pt.created) < JWTMinInterval {
+		return false
+	}
+	pt.jwt = ""
+	return true
 }
 
+// jwtHeader описывает заголовок JWT провайдера.
+type jwtHeader struct {
+	Alg string `json:"alg"` // алгоритм подписи: всегда ES256
+	Kid string `json:"kid"` // Key ID
+}
+
+// jwtClaims описывает утверждения JWT провайдера.
+type jwtClaims struct {
+	Iss string `json:"iss"` // Team ID
+	Iat int64  `json:"iat"` // время создания в секундах
+}
+
+// createJWT создает и сохраняет новый JWT. Вызывается с заблокированным
+// ProviderToken.
 func (pt *ProviderToken) createJWT() (string, error) {
 	if pt.privateKey == nil {
 		return "", ErrPTBadPrivateKey
 	}
-	buf := []byte(`************` +
-		`{"alg":"ES256","kid":"0000000000"}.` + // header
-		`*************` +
-		`{"iss":"0000000000","iat":0000000000}.` + // claims
-		`*******************************************` +
-		`*******************************************`) // sign
-	// header
-	copy(buf[34:44], pt.keyID[:10])
-	base64.RawURLEncoding.Encode(buf[:46], buf[12:46])
-	// claims
-	copy(buf[68:78], pt.teamID[:10])
 	created := time.Now()
-	copy(buf[86:96], []byte(strconv.FormatInt(created.Unix(), 10)))
-	base64.RawURLEncoding.Encode(buf[47:97], buf[60:97])
-	// sign
-	sum := sha256.Sum256(buf[:97])
-	r, s, err := ecdsa.Sign(rand.Reader, pt.privateKey, sum[:])
+	token, err := signJWT(pt.privateKey,
+		&jwtHeader{Alg: "ES256", Kid: string(pt.keyID[:])},
+		&jwtClaims{Iss: string(pt.teamID[:]), Iat: created.Unix()})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	copy(buf[120:152], r.Bytes())
-	copy(buf[152:186], s.Bytes())
-	base64.RawURLEncoding.Encode(buf[98:186], buf[120:186])
-	jwt := fmt.Sprintf("bearer %s", buf)
-	pt.mu.Lock()
+	jwt := "bearer " + token
 	pt.jwt = jwt
 	pt.created = created
-	pt.mu.Unlock()
 	return jwt, nil
 }
 
+// signJWT возвращает JWT с заголовком и утверждениями, подписанный ключом по
+// алгоритму ES256. Подпись состоит из r и s, каждое из которых дополнено
+// нулями слева до 32 байт.
+func signJWT(key *ecdsa.PrivateKey, header *jwtHeader, claims *jwtClaims) (
+	string, error) {
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsData, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	var encoding = base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(headerData) + "." +
+		encoding.EncodeToString(claimsData)
+	sum := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	const size = 32 // размер r и s для кривой P-256
+	if r.BitLen() > size*8 || s.BitLen() > size*8 {
+		return "", ErrPTBadPrivateKey
+	}
+	var sign = make([]byte, 2*size)
+	r.FillBytes(sign[:size])
+	s.FillBytes(sign[size:])
+	return unsigned + "." + encoding.EncodeToString(sign), nil
+}
+
 type jsonProviderToken struct {
 	TeamID     string `json:"teamId"`
 	KeyID      string `json:"keyId"`
@@ -198,6 +340,9 @@ func (pt *ProviderToken) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	if key.Curve != elliptic.P256() {
+		return ErrPTBadPrivateKey
+	}
 	copy(pt.teamID[:], jsonPT.TeamID)
 	copy(pt.keyID[:], jsonPT.KeyID)
 	pt.privateKey = key
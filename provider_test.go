@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProviderToken возвращает токен провайдера с новым ключом P-256.
+func newTestProviderToken(t *testing.T) (*ProviderToken, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := NewProviderToken("TEAM123456", "KEY1234567", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pt, key
+}
+
+// verifyTestJWT проверяет подпись JWT открытым ключом и возвращает заголовок
+// и утверждения токена.
+func verifyTestJWT(t *testing.T, jwt string, key *ecdsa.PublicKey) (
+	*jwtHeader, *jwtClaims) {
+	t.Helper()
+	if !strings.HasPrefix(jwt, "bearer ") {
+		t.Fatalf("bad authorization %q", jwt)
+	}
+	parts := strings.Split(strings.TrimPrefix(jwt, "bearer "), ".")
+	if len(parts) != 3 {
+		t.Fatalf("bad jwt %q", jwt)
+	}
+	var (
+		encoding = base64.RawURLEncoding
+		header   = new(jwtHeader)
+		claims   = new(jwtClaims)
+	)
+	for i, v := range []interface{}{header, claims} {
+		data, err := encoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatalf("bad jwt part %q: %v", parts[i], err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("bad jwt part %s: %v", data, err)
+		}
+	}
+	sign, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("bad jwt signature %q: %v", parts[2], err)
+	}
+	if len(sign) != 64 {
+		t.Fatalf("signature length %d", len(sign))
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sign[:32])
+	s := new(big.Int).SetBytes(sign[32:])
+	if !ecdsa.Verify(key, sum[:], r, s) {
+		t.Fatalf("bad jwt signature %q", jwt)
+	}
+	return header, claims
+}
+
+func TestProviderTokenJWT(t *testing.T) {
+	pt, key := newTestProviderToken(t)
+	jwt, err := pt.JWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims := verifyTestJWT(t, jwt, &key.PublicKey)
+	if header.Alg != "ES256" || header.Kid != "KEY1234567" {
+		t.Errorf("bad header: %+v", header)
+	}
+	if claims.Iss != "TEAM123456" {
+		t.Errorf("bad claims: %+v", claims)
+	}
+	if iat := time.Unix(claims.Iat, 0); time.Since(iat) > time.Minute {
+		t.Errorf("bad iat: %v", iat)
+	}
+	// токен кешируется
+	if cached, _ := pt.JWT(); cached != jwt {
+		t.Error("jwt not cached")
+	}
+	// устаревший токен создается заново
+	pt.created = pt.created.Add(-JWTLifeTime - time.Second)
+	if renewed, _ := pt.JWT(); renewed == jwt {
+		t.Error("jwt not renewed")
+	}
+}
+
+func TestProviderTokenSignature(t *testing.T) {
+	pt, key := newTestProviderToken(t)
+	// примерно каждая 128-я подпись содержит r или s с нулевым старшим байтом
+	var padded int
+	for i := 0; i < 2000; i++ {
+		jwt, err := pt.createJWT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyTestJWT(t, jwt, &key.PublicKey)
+		sign, _ := base64.RawURLEncoding.DecodeString(
+			jwt[strings.LastIndexByte(jwt, '.')+1:])
+		if sign[0] == 0 || sign[32] == 0 {
+			padded++
+		}
+	}
+	if padded == 0 {
+		t.Error("no signatures with leading zero bytes")
+	}
+}
+
+func TestProviderTokenErrors(t *testing.T) {
+	var pt *ProviderToken
+	if _, err := pt.JWT(); err != ErrPTNotSet {
+		t.Errorf("nil provider: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewProviderToken("TEAM123456", "KEY1234567", data); err != ErrPTBadPrivateKey {
+		t.Errorf("P-384 key: %v", err)
+	}
+	if _, err := NewProviderToken("TEAM", "KEY1234567", data); err != ErrPTBadTeamID {
+		t.Errorf("short team id: %v", err)
+	}
+	if _, err := NewProviderToken("TEAM123456", "KEY", data); err != ErrPTBadKeyID {
+		t.Errorf("short key id: %v", err)
+	}
+	if _, err := new(ProviderToken).createJWT(); err != ErrPTBadPrivateKey {
+		t.Errorf("no private key: %v", err)
+	}
+}
+
+func TestProviderTokenJSON(t *testing.T) {
+	pt, key := newTestProviderToken(t)
+	data, err := json.Marshal(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored = new(ProviderToken)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := restored.JWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestJWT(t, jwt, &key.PublicKey)
+}
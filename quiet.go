@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// StatusScheduled — статус уведомления, отложенного до окончания тихих часов
+// пользователя.
+const StatusScheduled = "scheduled"
+
+// ClockTime описывает время суток в минутах от полуночи, которое задается в
+// формате 15:04.
+type ClockTime int
+
+// MarshalJSON возвращает время суток в виде строки JSON.
+func (t ClockTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%02d:%02d", t/60, t%60))
+}
+
+// UnmarshalJSON разбирает время суток из строки JSON.
+func (t *ClockTime) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return fmt.Errorf("bad time of day %q", value)
+	}
+	*t = ClockTime(clock.Hour()*60 + clock.Minute())
+	return nil
+}
+
+// QuietHours описывает интервал времени суток, в течение которого уведомления
+// не доставляются. Интервал может переходить через полночь, например, с 22:00
+// до 08:00. Одинаковое время начала и окончания отключает тихие часы.
+type QuietHours struct {
+	Start    ClockTime `json:"start"`
+	End      ClockTime `json:"end"`
+	TimeZone string    `json:"timeZone,omitempty"` // по умолчанию UTC
+}
+
+// Until возвращает время окончания тихих часов, если указанное время в них
+// попадает, иначе — нулевое время. Время суток считается в указанной зоне.
+func (q *QuietHours) Until(now time.Time, loc *time.Location) time.Time {
+	if q == nil || q.Start == q.End {
+		return time.Time{}
+	}
+	now = now.In(loc)
+	var (
+		minutes    = ClockTime(now.Hour()*60 + now.Minute())
+		year, m, d = now.Date()
+	)
+	if q.Start < q.End {
+		if minutes < q.Start || minutes >= q.End {
+			return time.Time{}
+		}
+	} else {
+		if minutes < q.Start && minutes >= q.End {
+			return time.Time{}
+		}
+		if minutes >= q.Start {
+			d++ // окончание на следующий день
+		}
+	}
+	return time.Date(year, m, d, int(q.End/60), int(q.End%60), 0, 0, loc)
+}
+
+// UserProfile описывает настройки пользователя для темы.
+type UserProfile struct {
+	TimeZone   string      `json:"timeZone,omitempty"`   // например Europe/Moscow
+	QuietHours *QuietHours `json:"quietHours,omitempty"` // вместо заданных для темы
+}
+
+// validTimeZone возвращает ошибку, если зона времени не известна.
+func validTimeZone(name string) error {
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("bad time zone %q", name)
+	}
+	return nil
+}
+
+// QuietHoursConfig задает тихие часы для тем. Тихие часы с ключом "*"
+// применяются ко всем темам, для которых они не заданы явно.
+type QuietHoursConfig map[string]*QuietHours
+
+// Topic возвращает тихие часы для темы.
+func (q QuietHoursConfig) Topic(topic string) *QuietHours {
+	if quiet, ok := q[topic]; ok {
+		return quiet
+	}
+	return q["*"]
+}
+
+// QuietUntil возвращает для токенов, пользователи которых находятся в тихих
+// часах, время их окончания. Тихие часы берутся из профиля пользователя или из
+// настроек темы, а зона времени — из сведений о токене, профиля пользователя
+// или тихих часов.
+func (c *Config) QuietUntil(topic string, sandbox bool, tokens []string,
+	now time.Time) (map[string]time.Time, error) {
+	var result = make(map[string]time.Time)
+	users, err := c.Store.GetTokensUsers(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := c.Store.GetTokensMeta(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	var profiles = make(map[string]*UserProfile)
+	for _, token := range tokens {
+		user, ok := users[token]
+		if !ok {
+			continue
+		}
+		profile, ok := profiles[user]
+		if !ok {
+			if profile, err = c.Store.GetUserProfile(topic, user); err != nil {
+				return nil, err
+			}
+			if profile == nil {
+				profile = new(UserProfile)
+			}
+			profiles[user] = profile
+		}
+		quiet := profile.QuietHours
+		if quiet == nil {
+			quiet = c.QuietHours.Topic(topic)
+		}
+		if quiet == nil {
+			continue
+		}
+		var zone = quiet.TimeZone
+		if profile.TimeZone != "" {
+			zone = profile.TimeZone
+		}
+		if meta[token] != nil && meta[token].TimeZone != "" {
+			zone = meta[token].TimeZone
+		}
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			loc = time.UTC
+		}
+		if until := quiet.Until(now, loc); !until.IsZero() {
+			result[token] = until
+		}
+	}
+	return result, nil
+}
+
+// GetUserProfile отдает профиль пользователя.
+func (s *Service) GetUserProfile(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	profile, err := s.config.Store.GetUserProfile(topic, user)
+	if err != nil {
+		return err
+	}
+	if profile == nil {
+		profile = new(UserProfile)
+	}
+	return c.Write(rest.JSON{"profile": profile})
+}
+
+// SetUserProfile заменяет профиль пользователя.
+func (s *Service) SetUserProfile(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	var profile = new(UserProfile)
+	if err := c.Bind(profile); err != nil {
+		return err
+	}
+	for _, zone := range []string{profile.TimeZone, quietTimeZone(profile.QuietHours)} {
+		if err := validTimeZone(zone); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := s.config.Store.SetUserProfile(topic, user, profile); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"profile": profile})
+}
+
+// quietTimeZone возвращает зону времени тихих часов.
+func quietTimeZone(quiet *QuietHours) string {
+	if quiet == nil {
+		return ""
+	}
+	return quiet.TimeZone
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip(err)
+	}
+	var night = &QuietHours{Start: 22 * 60, End: 8 * 60}
+	var lunch = &QuietHours{Start: 13 * 60, End: 14 * 60}
+	// at возвращает время в январе 2024 года в Москве
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, loc)
+	}
+	for i, test := range []struct {
+		quiet *QuietHours
+		now   time.Time
+		until time.Time
+	}{
+		{night, at(10, 23, 30), at(11, 8, 0)},
+		{night, at(10, 22, 0), at(11, 8, 0)},
+		{night, at(10, 7, 59), at(10, 8, 0)},
+		{night, at(10, 8, 0), time.Time{}},
+		{night, at(10, 12, 0), time.Time{}},
+		{lunch, at(10, 13, 30), at(10, 14, 0)},
+		{lunch, at(10, 14, 0), time.Time{}},
+		{&QuietHours{Start: 60, End: 60}, at(10, 1, 0), time.Time{}},
+		{nil, at(10, 1, 0), time.Time{}},
+	} {
+		// время окончания не зависит от зоны исходного времени
+		until := test.quiet.Until(test.now.UTC(), loc)
+		if !until.Equal(test.until) {
+			t.Errorf("%d: until %v, want %v", i, until, test.until)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	// тихие часы с часу назад до часа вперед по UTC
+	var now = time.Now().UTC()
+	var minutes = now.Hour()*60 + now.Minute()
+	var quiet = &QuietHours{
+		Start: ClockTime((minutes + 23*60) % (24 * 60)),
+		End:   ClockTime((minutes + 60) % (24 * 60)),
+	}
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.QuietHours = QuietHoursConfig{"*": quiet}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	resp := ts.expect(http.StatusOK, "POST", path, testPayload)
+	if status := sent(t, resp); status["AAAA"] != StatusScheduled {
+		t.Errorf("quiet hours: %v", status)
+	}
+	if n := len(ts.apns.Requests()); n != 0 {
+		t.Errorf("apns requests: %d", n)
+	}
+	scheduled, err := ts.config.Store.GetScheduled(now.Add(2*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 1 || scheduled[0].Notification.Token != "AAAA" ||
+		scheduled[0].At.Before(now) {
+		t.Errorf("scheduled: %+v", scheduled)
+	}
+	// срочное уведомление отправляется сразу
+	resp = ts.expect(http.StatusOK, "POST", path, map[string]interface{}{
+		"payload": testPayload["payload"],
+		"urgent":  true,
+	})
+	if status := sent(t, resp); status["AAAA"] != "OK" {
+		t.Errorf("urgent: %v", status)
+	}
+	// профиль пользователя отключает тихие часы темы
+	ts.expect(http.StatusOK, "PUT", "/apns/"+testTopic+"/users/dmitrys/profile",
+		map[string]interface{}{
+			"quietHours": map[string]interface{}{"start": "00:00", "end": "00:00"},
+		})
+	resp = ts.expect(http.StatusOK, "POST", path, testPayload)
+	if status := sent(t, resp); status["AAAA"] != "OK" {
+		t.Errorf("profile: %v", status)
+	}
+	ts.expect(http.StatusBadRequest, "PUT", "/apns/"+testTopic+"/users/dmitrys/profile",
+		map[string]interface{}{"timeZone": "Mars/Olympus"})
+	ts.expect(http.StatusBadRequest, "PUT", "/apns/"+testTopic+"/users/dmitrys/profile",
+		map[string]interface{}{
+			"quietHours": map[string]interface{}{"start": "25:00", "end": "08:00"},
+		})
+	// отложенное уведомление отправляется в назначенное время
+	ts.apns.Reset()
+	var notification = scheduled[0].Notification
+	if err := ts.config.Schedule(time.Now(), &notification); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(ts.apns.Requests()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduled push not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		list, err := ts.config.Store.GetScheduled(now.Add(2*time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) == 1 {
+			break // осталось уведомление до окончания тихих часов
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("scheduled after send: %d", len(list))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
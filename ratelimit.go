@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// Limit описывает ограничение частоты запросов на отправку уведомлений и
+// месячную квоту уведомлений.
+type Limit struct {
+	Rate  float64 `json:"rate,omitempty"`  // запросов в секунду
+	Burst int     `json:"burst,omitempty"` // запросов без ожидания
+	Quota int64   `json:"quota,omitempty"` // уведомлений в календарный месяц
+}
+
+// LimitsConfig описывает ограничения для пользователей и тем. Ограничение с
+// ключом "*" применяется ко всем пользователям или темам, для которых оно не
+// задано явно.
+type LimitsConfig struct {
+	Users  map[string]*Limit `json:"users,omitempty"`
+	Topics map[string]*Limit `json:"topics,omitempty"`
+}
+
+// limitFor возвращает ограничение для указанного имени или ограничение по
+// умолчанию.
+func limitFor(limits map[string]*Limit, name string) *Limit {
+	if limit, ok := limits[name]; ok {
+		return limit
+	}
+	return limits["*"]
+}
+
+// LimitState описывает состояние ограничения для заголовков X-RateLimit-*.
+type LimitState struct {
+	Limit     int64         // размер корзины или квоты
+	Remaining int64         // оставшееся количество
+	Reset     time.Duration // время до восстановления
+}
+
+// usageMonth возвращает календарный месяц, к которому относится время, в
+// формате 2006-01.
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// nextMonth возвращает время начала следующего календарного месяца.
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// usageKey возвращает ключ счетчика уведомлений пользователя или темы.
+func usageKey(kind, name string) string {
+	return kind + ":" + name
+}
+
+// rateLimits хранит ограничители частоты запросов пользователей и тем.
+type rateLimits struct {
+	limiters map[string]*Limiter
+	mu       sync.Mutex
+}
+
+// limiter возвращает ограничитель частоты для ключа, создавая его при
+// первом обращении.
+func (r *rateLimits) limiter(key string, limit *Limit) *Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiters == nil {
+		r.limiters = make(map[string]*Limiter)
+	}
+	limiter, ok := r.limiters[key]
+	if !ok {
+		burst := limit.Burst
+		if burst < 1 {
+			burst = int(math.Ceil(limit.Rate))
+		}
+		limiter = NewLimiter(limit.Rate, burst)
+		r.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// usageCounter — ключ контекста запроса с учетом уведомлений в квотах.
+type usageCounter struct{}
+
+// quotaUsage резервирует и учитывает уведомления запроса в месячных квотах
+// пользователя и темы.
+type quotaUsage struct {
+	store    *Store
+	month    string
+	quotas   map[string]int64 // квоты по ключам счетчиков, 0 — без квоты
+	reset    time.Duration    // время до начала следующего месяца
+	reserved int64            // зарезервировано до отправки
+	counted  bool
+}
+
+// reserve резервирует уведомления в квотах до отправки. Возвращает false,
+// если уведомлений больше, чем осталось в одной из квот.
+func (u *quotaUsage) reserve(count int) (bool, error) {
+	ok, err := u.store.ReserveUsage(u.month, int64(count), u.quotas)
+	if ok {
+		u.reserved += int64(count)
+	}
+	return ok, err
+}
+
+// count учитывает отправленные уведомления вместо зарезервированных.
+func (u *quotaUsage) count(count int) {
+	if u.counted {
+		return
+	}
+	u.counted = true
+	var keys = make([]string, 0, len(u.quotas))
+	for key := range u.quotas {
+		keys = append(keys, key)
+	}
+	if err := u.store.AddUsage(u.month, int64(count)-u.reserved, keys...); err != nil {
+		log.WithError(err).Error("save usage error")
+	}
+}
+
+// reserveUsage резервирует уведомления в квотах запроса, если для него заданы
+// ограничения. Если квоты не хватает, то возвращается ошибка со статусом 429.
+func reserveUsage(c *rest.Context, count int) error {
+	usage, ok := c.Get(usageCounter{}).(*quotaUsage)
+	if !ok {
+		return nil
+	}
+	ok, err := usage.reserve(count)
+	if err != nil || ok {
+		return err
+	}
+	c.SetHeader("Retry-After", strconv.FormatInt(
+		int64(math.Ceil(usage.reset.Seconds())), 10))
+	return c.Error(http.StatusTooManyRequests, fmt.Sprintf(
+		"quota exceeded: %d notifications requested", count))
+}
+
+// countUsage учитывает отправленные уведомления в квотах пользователя и темы
+// запроса, если для него заданы ограничения.
+func countUsage(c *rest.Context, count int) {
+	if usage, ok := c.Get(usageCounter{}).(*quotaUsage); ok {
+		usage.count(count)
+	}
+}
+
+// limited возвращает обработчик, который перед выполнением запроса проверяет
+// ограничения частоты запросов и месячные квоты авторизованного пользователя
+// и темы. При превышении ограничения запрос отклоняется со статусом 429 и
+// заголовком Retry-After. Уведомления запроса резервируются в квотах
+// обработчиком до отправки с помощью reserveUsage. Заголовки X-RateLimit-*
+// описывают самое строгое из примененных ограничений.
+func (s *Service) limited(auth, handler rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		limits := s.config.Limits
+		if limits == nil {
+			return handler(c)
+		}
+		if err := auth(c); err != nil {
+			return err
+		}
+		login, _, _ := c.BasicAuth()
+		if login == "" {
+			login = s.certificateLogin(c)
+		}
+		var checks = make(map[string]*Limit, 2)
+		if login != "" {
+			if limit := limitFor(limits.Users, login); limit != nil {
+				checks[usageKey("user", login)] = limit
+			}
+		}
+		topic := c.Param("topic")
+		if limit := limitFor(limits.Topics, topic); limit != nil {
+			checks[usageKey("topic", topic)] = limit
+		}
+		if len(checks) == 0 {
+			return handler(c)
+		}
+		var (
+			now   = time.Now()
+			month = usageMonth(now)
+			state *LimitState // самое строгое ограничение
+			retry time.Duration
+		)
+		// tighter запоминает ограничение с наименьшим остатком
+		tighter := func(next *LimitState) {
+			if state == nil || next.Remaining < state.Remaining {
+				state = next
+			}
+		}
+		usage, err := s.config.Store.GetUsage(month)
+		if err != nil {
+			return err
+		}
+		for key, limit := range checks {
+			if limit.Quota <= 0 {
+				continue
+			}
+			var next = &LimitState{
+				Limit:     limit.Quota,
+				Remaining: limit.Quota - usage[key],
+				Reset:     nextMonth(now).Sub(now),
+			}
+			if next.Remaining <= 0 {
+				next.Remaining = 0
+				if next.Reset > retry {
+					retry = next.Reset
+				}
+			}
+			tighter(next)
+		}
+		if retry == 0 {
+			var taken []*Limiter // ограничители, из которых забрано событие
+			for key, limit := range checks {
+				limiter := s.limits.limiter(key, limit)
+				next, ok := limiter.Allow()
+				if next == nil {
+					continue
+				}
+				if ok {
+					taken = append(taken, limiter)
+				} else if next.Reset > retry {
+					retry = next.Reset
+				}
+				tighter(next)
+			}
+			// отклоненный запрос не расходует остальные ограничения
+			if retry > 0 {
+				for _, limiter := range taken {
+					limiter.Release()
+				}
+			}
+		}
+		if state != nil {
+			c.SetHeader("X-RateLimit-Limit", strconv.FormatInt(state.Limit, 10))
+			c.SetHeader("X-RateLimit-Remaining", strconv.FormatInt(state.Remaining, 10))
+			c.SetHeader("X-RateLimit-Reset", strconv.FormatInt(
+				int64(math.Ceil(state.Reset.Seconds())), 10))
+		}
+		if retry > 0 {
+			log.WithFields(log.Fields{
+				"user":  login,
+				"topic": topic,
+				"retry": retry,
+			}).Warning("rate limit exceeded")
+			c.SetHeader("Retry-After", strconv.FormatInt(
+				int64(math.Ceil(retry.Seconds())), 10))
+			return c.Error(http.StatusTooManyRequests, "rate limit exceeded")
+		}
+		// учитываем отправленные уведомления в квотах
+		var quota = &quotaUsage{
+			store:  s.config.Store,
+			month:  month,
+			quotas: make(map[string]int64, len(checks)),
+			reset:  nextMonth(now).Sub(now),
+		}
+		for key, limit := range checks {
+			quota.quotas[key] = limit.Quota
+		}
+		c.Set(usageCounter{}, quota)
+		err = handler(c)
+		// отправка прервана: учитываем уже отправленные уведомления и
+		// освобождаем остальной резерв
+		var sent int
+		if pusherr, ok := err.(*pushError); ok {
+			sent = len(pusherr.sent)
+		}
+		quota.count(sent)
+		return err
+	}
+}
+
+// usageInfo описывает использование квоты пользователем или темой.
+type usageInfo struct {
+	Used  int64   `json:"used"`
+	Quota int64   `json:"quota,omitempty"`
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// GetUsage отдает количество отправленных уведомлений по пользователям и
+// темам за месяц и их ограничения. Параметр month задает месяц в формате
+// 2006-01, по умолчанию — текущий.
+func (s *Service) GetUsage(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	month := c.Request.URL.Query().Get("month")
+	if month == "" {
+		month = usageMonth(time.Now())
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		return c.Error(http.StatusBadRequest, fmt.Sprintf("bad month %s", month))
+	}
+	usage, err := s.config.Store.GetUsage(month)
+	if err != nil {
+		return err
+	}
+	var result = map[string]map[string]*usageInfo{
+		"user":  make(map[string]*usageInfo),
+		"topic": make(map[string]*usageInfo),
+	}
+	var limits = s.config.Limits
+	if limits == nil {
+		limits = new(LimitsConfig)
+	}
+	// info возвращает описание использования, добавляя его при необходимости
+	info := func(kind, name string) *usageInfo {
+		item, ok := result[kind][name]
+		if !ok {
+			item = new(usageInfo)
+			var limit *Limit
+			if kind == "user" {
+				limit = limitFor(limits.Users, name)
+			} else {
+				limit = limitFor(limits.Topics, name)
+			}
+			if limit != nil {
+				item.Quota, item.Rate, item.Burst = limit.Quota, limit.Rate, limit.Burst
+			}
+			result[kind][name] = item
+		}
+		return item
+	}
+	for name := range limits.Users {
+		if name != "*" {
+			info("user", name)
+		}
+	}
+	for name := range limits.Topics {
+		if name != "*" {
+			info("topic", name)
+		}
+	}
+	for key, used := range usage {
+		for kind := range result {
+			if name := strings.TrimPrefix(key, kind+":"); name != key {
+				info(kind, name).Used = used
+			}
+		}
+	}
+	return c.Write(rest.JSON{
+		"month":  month,
+		"users":  result["user"],
+		"topics": result["topic"],
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Limits = &LimitsConfig{
+			Users: map[string]*Limit{"dmitrys": {Rate: 0.001, Burst: 2}},
+		}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	ts.config.AddUser("dmitrys", "pass")
+	ts.config.AddUser("test", "pass")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	for i := 1; i >= 0; i-- {
+		resp := ts.expect(http.StatusOK, "POST", path, testPayload, "dmitrys", "pass")
+		if remaining := resp.header.Get("X-RateLimit-Remaining"); remaining != strconv.Itoa(i) {
+			t.Errorf("X-RateLimit-Remaining: %q", remaining)
+		}
+		if limit := resp.header.Get("X-RateLimit-Limit"); limit != "2" {
+			t.Errorf("X-RateLimit-Limit: %q", limit)
+		}
+	}
+	status, resp := ts.request("POST", path, testPayload, "dmitrys", "pass")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("rate limit: status %d", status)
+	}
+	if retry, _ := strconv.Atoi(resp.header.Get("Retry-After")); retry <= 0 {
+		t.Errorf("Retry-After: %q", resp.header.Get("Retry-After"))
+	}
+	if n := len(ts.apns.Requests()); n != 2 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// ограничение не распространяется на других пользователей
+	ts.expect(http.StatusOK, "POST", path, testPayload, "test", "pass")
+	// авторизация проверяется раньше исчерпанного ограничения
+	ts.expect(http.StatusForbidden, "POST", path, testPayload, "dmitrys", "bad")
+}
+
+func TestQuota(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Limits = &LimitsConfig{
+			Topics: map[string]*Limit{"*": {Quota: 3}},
+		}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.addTokens("test", false, "CCCC")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	resp := ts.expect(http.StatusOK, "POST", path, testPayload)
+	if remaining := resp.header.Get("X-RateLimit-Remaining"); remaining != "3" {
+		t.Errorf("X-RateLimit-Remaining: %q", remaining)
+	}
+	// запрос, превышающий остаток квоты, отклоняется до отправки
+	status, resp := ts.request("POST", path, testPayload)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("quota: status %d", status)
+	}
+	if resp.header.Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	// резерв неотправленного запроса освобождается
+	ts.expect(http.StatusBadRequest, "POST", "/apns/"+testTopic+"/users/test/push",
+		map[string]interface{}{"payload": map[string]interface{}{"aps": map[string]interface{}{}}})
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/test/push", testPayload)
+	ts.expect(http.StatusTooManyRequests, "POST", "/apns/"+testTopic+"/users/test/push",
+		testPayload)
+	if n := len(ts.apns.Requests()); n != 3 {
+		t.Errorf("apns requests: %d", n)
+	}
+	// использование квоты
+	resp = ts.expect(http.StatusOK, "GET", "/usage", nil)
+	var usage struct {
+		Topics map[string]*usageInfo `json:"topics"`
+	}
+	resp.Decode(t, &usage)
+	if info := usage.Topics[testTopic]; info == nil || info.Used != 3 || info.Quota != 3 {
+		t.Errorf("usage: %+v", info)
+	}
+	ts.expect(http.StatusBadRequest, "GET", "/usage?month=bad", nil)
+}
+
+func TestRateLimitRejected(t *testing.T) {
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Limits = &LimitsConfig{
+			Users:  map[string]*Limit{"dmitrys": {Rate: 0.001, Burst: 2}},
+			Topics: map[string]*Limit{testTopic: {Rate: 0.001, Burst: 1}},
+		}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	ts.config.AddUser("dmitrys", "pass")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	ts.expect(http.StatusOK, "POST", path, testPayload, "dmitrys", "pass")
+	// запрос, отклоненный ограничением темы, не расходует ограничение
+	// пользователя
+	for i := 0; i < 3; i++ {
+		ts.expect(http.StatusTooManyRequests, "POST", path, testPayload, "dmitrys", "pass")
+	}
+	limiter := ts.service.limits.limiter(usageKey("user", "dmitrys"), nil)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.tokens < 1 {
+		t.Errorf("user limit tokens: %v", limiter.tokens)
+	}
+}
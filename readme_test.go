@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readmeExample описывает пример запроса из readme.md.
+type readmeExample struct {
+	Method   string          // метод запроса
+	Path     string          // путь запроса
+	Request  json.RawMessage // тело запроса
+	Code     int             // код ответа, 0 — любой успешный
+	Response json.RawMessage // тело ответа
+	line     int             // строка заголовка примера
+}
+
+// readmeExamples разбирает из readme.md разделы с заголовками вида
+// "## METHOD /path" и описанием запроса и ответа в формате API Blueprint.
+func readmeExamples(filename string) ([]*readmeExample, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var (
+		examples []*readmeExample
+		example  *readmeExample
+		body     *json.RawMessage // тело, которое сейчас читается
+		section  *json.RawMessage // тело текущего раздела запроса или ответа
+		lines    []string
+		scanner  = bufio.NewScanner(file)
+		number   int
+	)
+	// flush сохраняет прочитанное тело запроса или ответа
+	flush := func() {
+		if body != nil {
+			*body = json.RawMessage(strings.Join(lines, "\n"))
+		}
+		body, lines = nil, nil
+	}
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if body != nil {
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "            ") {
+				lines = append(lines, line)
+				continue
+			}
+			flush()
+		}
+		switch {
+		case strings.HasPrefix(line, "## "):
+			example, section = nil, nil
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "GET", "POST", "PUT", "DELETE":
+				example = &readmeExample{
+					Method: fields[1],
+					Path:   fields[2],
+					line:   number,
+				}
+				examples = append(examples, example)
+			}
+		case example == nil:
+		case strings.HasPrefix(line, "+ Request"):
+			section = &example.Request
+		case strings.HasPrefix(line, "+ Response "):
+			fields := strings.Fields(line)
+			if example.Code, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, err
+			}
+			section = &example.Response
+		case strings.TrimSpace(line) == "+ Body" && section != nil:
+			body = section
+		}
+	}
+	flush()
+	return examples, scanner.Err()
+}
+
+// TestReadmeExamples выполняет примеры запросов из readme.md по порядку и
+// сравнивает код ответа и ключи данных с описанными.
+func TestReadmeExamples(t *testing.T) {
+	examples, err := readmeExamples("readme.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(examples) == 0 {
+		t.Fatal("no examples in readme.md")
+	}
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.History = HistoryConfig{"*": {}} // для примеров истории
+	})
+	// токены пользователей, на которые ссылаются примеры
+	ts.addTokens("dmitrys", false, "507C1666D7ECA6", "6B0420FA3B631D")
+	ts.addTokens("43892780306469875", false, "BE311B5BADA725")
+	ts.expect(http.StatusCreated, "POST", "/apns/"+testTopic+"/users/dmitrys",
+		map[string]string{"token": "VOIP1666D7ECA6", "kind": TokenVoIP})
+	ts.expect(http.StatusOK, "PUT", "/apns/"+testTopic+"/tokens/6B0420FA3B631D/tags",
+		map[string][]string{"tags": {"beta"}})
+	for _, example := range examples {
+		var body interface{}
+		if len(example.Request) > 0 {
+			if err := json.Unmarshal(example.Request, &body); err != nil {
+				t.Errorf("readme.md:%d: bad request: %v", example.line, err)
+				continue
+			}
+		}
+		status, resp := ts.request(example.Method, example.Path, body)
+		if example.Code == 0 && status >= http.StatusMultipleChoices ||
+			example.Code != 0 && status != example.Code {
+			t.Errorf("readme.md:%d: %s %s: status %d, want %d",
+				example.line, example.Method, example.Path, status, example.Code)
+			continue
+		}
+		if len(example.Response) == 0 {
+			continue
+		}
+		var want struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(example.Response, &want); err != nil {
+			t.Errorf("readme.md:%d: bad response: %v", example.line, err)
+			continue
+		}
+		var data map[string]json.RawMessage
+		resp.Decode(t, &data)
+		for key := range want.Data {
+			if _, ok := data[key]; !ok {
+				t.Errorf("readme.md:%d: %s %s: no %q in response data",
+					example.line, example.Method, example.Path, key)
+			}
+		}
+	}
+}
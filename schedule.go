@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// ScheduledPush описывает уведомление на один токен, отложенное до указанного
+// времени.
+type ScheduledPush struct {
+	ID           string       `json:"id"`
+	At           time.Time    `json:"at"` // время отправки
+	Notification Notification `json:"notification"`
+}
+
+var (
+	// ScheduleRetry задает задержку повторной отправки отложенных
+	// уведомлений после ошибки.
+	ScheduleRetry = time.Minute
+	// schedulePoll задает наибольший интервал проверки расписания.
+	schedulePoll = time.Minute
+	// scheduleBatch задает количество уведомлений, читаемых из расписания за
+	// один раз.
+	scheduleBatch = 100
+)
+
+// pushScheduler отправляет уведомления из расписания в хранилище, когда
+// наступает время их отправки. Расписание хранится в хранилище, поэтому
+// уведомления отправляются и после перезапуска сервиса.
+type pushScheduler struct {
+	config *Config
+	wake   chan struct{} // сигнал об изменении расписания
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// newPushScheduler запускает отправку уведомлений по расписанию.
+func newPushScheduler(config *Config) *pushScheduler {
+	var scheduler = &pushScheduler{
+		config: config,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	scheduler.wg.Add(1)
+	go scheduler.run()
+	return scheduler
+}
+
+// Close останавливает отправку по расписанию и дожидается ее завершения.
+func (s *pushScheduler) Close() {
+	s.once.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+// Wake сообщает об изменении расписания.
+func (s *pushScheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run отправляет уведомления, время которых наступило, и ожидает времени
+// следующего уведомления или изменения расписания.
+func (s *pushScheduler) run() {
+	defer s.wg.Done()
+	for {
+		var wait = schedulePoll
+		if next := s.dispatch(); !next.IsZero() {
+			if until := time.Until(next); until < wait {
+				wait = until
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// dispatch отправляет уведомления, время которых наступило, и возвращает
+// время следующей отправки. При ошибке соединения уведомление остается в
+// расписании и отправляется повторно через ScheduleRetry.
+func (s *pushScheduler) dispatch() time.Time {
+	var store = s.config.Store
+	for {
+		var now = time.Now()
+		list, err := store.GetScheduled(now, scheduleBatch)
+		if err != nil {
+			log.WithError(err).Error("get scheduled error")
+			return now.Add(ScheduleRetry)
+		}
+		for _, push := range list {
+			select {
+			case <-s.stop:
+				return time.Time{}
+			default:
+			}
+			var notification = push.Notification
+			if notification.Expiration.IsZero() ||
+				notification.Expiration.After(now) {
+				_, err := s.config.pushDeferred(notification)
+				// ошибка соединения: повторяем позже, отказ APNS не повторяем
+				if _, ok := err.(*Error); err != nil && !ok {
+					log.WithError(err).WithFields(log.Fields{
+						"id":    push.ID,
+						"token": notification.Token,
+						"topic": notification.Topic,
+					}).Error("scheduled push error")
+					return now.Add(ScheduleRetry)
+				}
+			}
+			if err := store.RemoveScheduled(push.ID); err != nil {
+				log.WithError(err).Error("remove scheduled error")
+				return now.Add(ScheduleRetry)
+			}
+		}
+		if len(list) < scheduleBatch {
+			break
+		}
+	}
+	next, err := store.NextScheduled()
+	if err != nil {
+		log.WithError(err).Error("get scheduled error")
+		return time.Now().Add(ScheduleRetry)
+	}
+	return next
+}
+
+// Schedule сохраняет уведомление на один токен в расписании для отправки в
+// указанное время.
+func (c *Config) Schedule(at time.Time, notification *Notification) error {
+	_, err := c.schedule(at, notification)
+	return err
+}
+
+// schedule сохраняет уведомление в расписании и возвращает его
+// идентификатор в расписании.
+func (c *Config) schedule(at time.Time, notification *Notification) (string, error) {
+	var push = &ScheduledPush{At: at.UTC(), Notification: *notification}
+	if err := c.Store.SaveScheduled(push); err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{
+		"token": notification.Token,
+		"topic": notification.Topic,
+		"at":    push.At,
+	}).Debug("push scheduled")
+	if c.scheduler != nil {
+		c.scheduler.Wake()
+	}
+	return push.ID, nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -42,6 +46,13 @@ func bucketName(topic string, sandbox bool) []byte {
 	return []byte(topic)
 }
 
+// dataBucketName возвращает имя раздела хранилища с дополнительными данными
+// указанного вида для темы. Двоеточие не допускается в идентификаторе
+// приложения, поэтому такие имена не пересекаются с именами тем.
+func dataBucketName(kind, topic string, sandbox bool) []byte {
+	return append([]byte(kind+":"), bucketName(topic, sandbox)...)
+}
+
 // userValue возвращает текущее время в виде количества секунд и имя
 // пользователя в бинарном виде.
 func userValue(user string) []byte {
@@ -57,10 +68,56 @@ func timeAndName(data []byte) (time.Time, string) {
 	return time.Unix(sec, 0), string(data[n:])
 }
 
+// Виды токенов, хранящихся в отдельных разделах хранилища.
+const (
+	TokenDevice = "device" // токены устройств для обычных уведомлений
+	TokenVoIP   = "voip"   // токены PushKit для VoIP-уведомлений
+)
+
+// ErrBadTokenKind возвращается для неизвестного вида токена.
+var ErrBadTokenKind = errors.New("bad token kind")
+
+// tokenBucketName возвращает имя раздела хранилища для токенов указанного
+// вида. Токены устройств хранятся в разделе с именем темы.
+func tokenBucketName(kind, topic string, sandbox bool) ([]byte, error) {
+	switch kind {
+	case TokenDevice, "":
+		return bucketName(topic, sandbox), nil
+	case TokenVoIP:
+		return dataBucketName(TokenVoIP, topic, sandbox), nil
+	default:
+		return nil, ErrBadTokenKind
+	}
+}
+
 // Save сохраняет токен устройства в хранилище.
 func (s *Store) Save(user, topic, token string, sandbox bool) error {
+	return s.saveToken(bucketName(topic, sandbox), user, token)
+}
+
+// SaveToken сохраняет токен указанного вида в хранилище.
+func (s *Store) SaveToken(kind, user, topic, token string, sandbox bool) error {
+	name, err := tokenBucketName(kind, topic, sandbox)
+	if err != nil {
+		return err
+	}
+	return s.saveToken(name, user, token)
+}
+
+// GetUserTokens возвращает список токенов указанного вида для пользователей
+// темы.
+func (s *Store) GetUserTokens(kind, topic string, sandbox bool, users ...string) ([]string, error) {
+	name, err := tokenBucketName(kind, topic, sandbox)
+	if err != nil {
+		return nil, err
+	}
+	return s.userTokens(name, users...)
+}
+
+// saveToken сохраняет токен пользователя в указанном разделе хранилища.
+func (s *Store) saveToken(name []byte, user, token string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(bucketName(topic, sandbox))
+		bucket, err := tx.CreateBucketIfNotExists(name)
 		if err != nil {
 			return err
 		}
@@ -70,6 +127,12 @@ func (s *Store) Save(user, topic, token string, sandbox bool) error {
 
 // GetUserTopicTokens возвращает список токенов пользователя для указанной темы.
 func (s *Store) GetUserTopicTokens(topic string, sandbox bool, users ...string) ([]string, error) {
+	return s.userTokens(bucketName(topic, sandbox), users...)
+}
+
+// userTokens возвращает список токенов пользователей из указанного раздела
+// хранилища.
+func (s *Store) userTokens(name []byte, users ...string) ([]string, error) {
 	if len(users) == 0 {
 		return nil, nil
 	}
@@ -79,7 +142,7 @@ func (s *Store) GetUserTopicTokens(topic string, sandbox bool, users ...string)
 	}
 	var list = make([]string, 0)
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(bucketName(topic, sandbox))
+		bucket := tx.Bucket(name)
 		if bucket == nil {
 			return nil
 		}
@@ -103,40 +166,1369 @@ func (s *Store) Remove(token, topic string, timestamp time.Time, sandbox bool) e
 	// 	timestamp = time.Now()
 	// }
 	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(bucketName(topic, sandbox))
-		if bucket == nil {
-			return nil
-		}
 		key := []byte(token)
 		// added, _ := timeAndName(bucket.Get(key))
 		// if added.Before(timestamp) {
 		// FIX: удаляем всегда, не смотря на время
-		bucket.Delete(key)
 		// }
+		// удаляем токен, его теги, токены VoIP и Live Activities независимо
+		// друг от друга: любой из разделов может отсутствовать
+		var names = [][]byte{bucketName(topic, sandbox)}
+		for _, kind := range []string{"tags", "meta", TokenVoIP, "pushtostart"} {
+			names = append(names, dataBucketName(kind, topic, sandbox))
+		}
+		for _, name := range names {
+			if bucket := tx.Bucket(name); bucket != nil {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		bucket := tx.Bucket(dataBucketName("activities", topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		var activities [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var activity = new(activityToken)
+			if json.Unmarshal(v, activity) == nil && activity.Token == token {
+				activities = append(activities, k)
+			}
+			return nil
+		})
+		for _, id := range activities {
+			if err := bucket.Delete(id); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
-// MarshalJSON возвращает путь к хранилищу в виде строки JSON.
-func (s *Store) MarshalJSON() ([]byte, error) {
-	return json.Marshal(s.db.Path())
+// putTags сохраняет список тегов с указанным ключом в разделе хранилища. Если
+// список пустой, то ключ удаляется.
+func (s *Store) putTags(name []byte, key string, tags []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return bucket.Delete([]byte(key))
+		}
+		data, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
 }
 
-// UnmarshalJSON получает путь к хранилищу из строки JSON и открывает его как
-// хранилище токенов устройств.
-func (s *Store) UnmarshalJSON(data []byte) error {
-	var path string
-	err := json.Unmarshal(data, &path)
+// getTags возвращает список тегов с указанным ключом из раздела хранилища.
+func (s *Store) getTags(name []byte, key string) ([]string, error) {
+	var tags = make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &tags)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// SetUserTags сохраняет теги пользователя для указанной темы. Теги
+// пользователя общие для sandbox и рабочего окружения.
+func (s *Store) SetUserTags(topic, user string, tags []string) error {
+	return s.putTags(dataBucketName("usertags", topic, false), user, tags)
+}
+
+// GetUserTags возвращает теги пользователя для указанной темы.
+func (s *Store) GetUserTags(topic, user string) ([]string, error) {
+	return s.getTags(dataBucketName("usertags", topic, false), user)
+}
+
+// SetTokenTags сохраняет теги токена устройства.
+func (s *Store) SetTokenTags(topic, token string, sandbox bool, tags []string) error {
+	return s.putTags(dataBucketName("tags", topic, sandbox), token, tags)
+}
+
+// GetTokenTags возвращает теги токена устройства.
+func (s *Store) GetTokenTags(topic, token string, sandbox bool) ([]string, error) {
+	return s.getTags(dataBucketName("tags", topic, sandbox), token)
+}
+
+// GetAudienceTokens возвращает список токенов для указанной темы, для которых
+// объединение тегов токена и тегов его пользователя удовлетворяет выражению.
+func (s *Store) GetAudienceTokens(topic string, sandbox bool, audience *Audience) ([]string, error) {
+	var list = make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName(topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		var (
+			userTags  = tx.Bucket(dataBucketName("usertags", topic, false))
+			tokenTags = tx.Bucket(dataBucketName("tags", topic, sandbox))
+			cache     = make(map[string][]string) // теги пользователей
+		)
+		// decode добавляет теги из раздела к набору
+		decode := func(bucket *bolt.Bucket, key string, tags map[string]struct{}) error {
+			if bucket == nil {
+				return nil
+			}
+			data := bucket.Get([]byte(key))
+			if data == nil {
+				return nil
+			}
+			var stored []string
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			for _, tag := range stored {
+				tags[tag] = struct{}{}
+			}
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			_, user := timeAndName(v)
+			var tags = make(map[string]struct{})
+			if cached, ok := cache[user]; ok {
+				for _, tag := range cached {
+					tags[tag] = struct{}{}
+				}
+			} else {
+				if err := decode(userTags, user, tags); err != nil {
+					return err
+				}
+				cached = make([]string, 0, len(tags))
+				for tag := range tags {
+					cached = append(cached, tag)
+				}
+				cache[user] = cached
+			}
+			if err := decode(tokenTags, string(k), tags); err != nil {
+				return err
+			}
+			if audience.Match(tags) {
+				list = append(list, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// TokenMeta описывает дополнительные сведения о токене устройства.
+type TokenMeta struct {
+	Locale   string `json:"locale,omitempty"`   // язык устройства, например de-AT
+	TimeZone string `json:"timeZone,omitempty"` // зона времени, например Europe/Moscow
+}
+
+// SetTokenMeta сохраняет дополнительные сведения о токене устройства. Пустые
+// поля meta не изменяют сохраненные ранее значения.
+func (s *Store) SetTokenMeta(topic, token string, sandbox bool, meta *TokenMeta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("meta", topic, sandbox))
+		if err != nil {
+			return err
+		}
+		var stored TokenMeta
+		if data := bucket.Get([]byte(token)); data != nil {
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+		}
+		if meta.Locale != "" {
+			stored.Locale = meta.Locale
+		}
+		if meta.TimeZone != "" {
+			stored.TimeZone = meta.TimeZone
+		}
+		data, err := json.Marshal(&stored)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(token), data)
+	})
+}
+
+// GetTokensMeta возвращает дополнительные сведения для списка токенов.
+// Токены без сохраненных сведений в результат не попадают.
+func (s *Store) GetTokensMeta(topic string, sandbox bool, tokens ...string) (map[string]*TokenMeta, error) {
+	var result = make(map[string]*TokenMeta, len(tokens))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("meta", topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		for _, token := range tokens {
+			data := bucket.Get([]byte(token))
+			if data == nil {
+				continue
+			}
+			var meta = new(TokenMeta)
+			if err := json.Unmarshal(data, meta); err != nil {
+				return err
+			}
+			result[token] = meta
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetTokensUsers возвращает логины пользователей, которым принадлежат токены
+// устройств. Незарегистрированные токены в результат не попадают.
+func (s *Store) GetTokensUsers(topic string, sandbox bool, tokens ...string) (map[string]string, error) {
+	var result = make(map[string]string, len(tokens))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName(topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		for _, token := range tokens {
+			if data := bucket.Get([]byte(token)); data != nil {
+				_, result[token] = timeAndName(data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetUserProfile сохраняет профиль пользователя для указанной темы. Профиль
+// пользователя общий для sandbox и рабочего окружения. Пустой профиль
+// удаляется.
+func (s *Store) SetUserProfile(topic, user string, profile *UserProfile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("profile", topic, false))
+		if err != nil {
+			return err
+		}
+		if profile == nil || *profile == (UserProfile{}) {
+			return bucket.Delete([]byte(user))
+		}
+		data, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), data)
+	})
+}
+
+// GetUserProfile возвращает профиль пользователя для указанной темы. Если
+// профиль не сохранен, то возвращается nil.
+func (s *Store) GetUserProfile(topic, user string) (profile *UserProfile, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("profile", topic, false))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(user))
+		if data == nil {
+			return nil
+		}
+		profile = new(UserProfile)
+		return json.Unmarshal(data, profile)
+	})
+	return
+}
+
+// AddBadge увеличивает счетчик непрочитанных уведомлений пользователя темы и
+// возвращает его новое значение. Счетчик пользователя общий для sandbox и
+// рабочего окружения.
+func (s *Store) AddBadge(topic, user string, delta int64) (badge int64, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("badges", topic, false))
+		if err != nil {
+			return err
+		}
+		if data := bucket.Get([]byte(user)); len(data) == 8 {
+			badge = int64(binary.BigEndian.Uint64(data))
+		}
+		if badge += delta; badge < 0 {
+			badge = 0
+		}
+		var value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(badge))
+		return bucket.Put([]byte(user), value)
+	})
+	return
+}
+
+// SetBadge устанавливает счетчик непрочитанных уведомлений пользователя темы.
+// Нулевой счетчик удаляется.
+func (s *Store) SetBadge(topic, user string, badge int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("badges", topic, false))
+		if err != nil {
+			return err
+		}
+		if badge <= 0 {
+			return bucket.Delete([]byte(user))
+		}
+		var value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(badge))
+		return bucket.Put([]byte(user), value)
+	})
+}
+
+// GetBadge возвращает счетчик непрочитанных уведомлений пользователя темы.
+func (s *Store) GetBadge(topic, user string) (badge int64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("badges", topic, false))
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get([]byte(user)); len(data) == 8 {
+			badge = int64(binary.BigEndian.Uint64(data))
+		}
+		return nil
+	})
+	return
+}
+
+// SaveTemplate сохраняет шаблон уведомления для темы.
+func (s *Store) SaveTemplate(topic string, template *Template) error {
+	data, err := json.Marshal(template)
 	if err != nil {
 		return err
 	}
-	if s.db != nil {
-		s.db.Close()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("templates", topic, false))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(template.Name), data)
+	})
+}
+
+// GetTemplate возвращает шаблон уведомления темы с указанным именем. Если
+// шаблон не найден, то возвращается nil.
+func (s *Store) GetTemplate(topic, name string) (template *Template, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("templates", topic, false))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		template = new(Template)
+		return json.Unmarshal(data, template)
+	})
+	return
+}
+
+// GetTemplates возвращает список имен шаблонов уведомлений темы.
+func (s *Store) GetTemplates(topic string) ([]string, error) {
+	var list = make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("templates", topic, false))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			list = append(list, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
-	store, err := bolt.Open(path, 0600, boltOptions)
+	return list, nil
+}
+
+// RemoveTemplate удаляет шаблон уведомления темы. Возвращает false, если
+// шаблон не был найден.
+func (s *Store) RemoveTemplate(topic, name string) (exist bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("templates", topic, false))
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return nil
+		}
+		exist = true
+		return bucket.Delete([]byte(name))
+	})
+	return
+}
+
+// SavePushToStartToken сохраняет токен пользователя для запуска Live Activity.
+// Эти токены хранятся отдельно от токенов устройств.
+func (s *Store) SavePushToStartToken(user, topic, token string, sandbox bool) error {
+	return s.saveToken(dataBucketName("pushtostart", topic, sandbox), user, token)
+}
+
+// GetPushToStartTokens возвращает список токенов пользователей для запуска Live
+// Activity.
+func (s *Store) GetPushToStartTokens(topic string, sandbox bool, users ...string) ([]string, error) {
+	return s.userTokens(dataBucketName("pushtostart", topic, sandbox), users...)
+}
+
+// activityToken описывает сохраненный токен Live Activity.
+type activityToken struct {
+	User    string    `json:"user"`
+	Token   string    `json:"token"`
+	Created time.Time `json:"created"`
+}
+
+// SaveActivityToken сохраняет токен для обновления Live Activity с указанным
+// идентификатором.
+func (s *Store) SaveActivityToken(user, topic, activity, token string, sandbox bool) error {
+	data, err := json.Marshal(&activityToken{
+		User:    user,
+		Token:   token,
+		Created: time.Now().UTC(),
+	})
 	if err != nil {
 		return err
 	}
-	s.db = store
-	return nil
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(
+			dataBucketName("activities", topic, sandbox))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(activity), data)
+	})
+}
+
+// GetActivityToken возвращает пользователя и токен Live Activity с указанным
+// идентификатором. Если активность не зарегистрирована, то возвращаются
+// пустые строки.
+func (s *Store) GetActivityToken(topic, activity string, sandbox bool) (user, token string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("activities", topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(activity))
+		if data == nil {
+			return nil
+		}
+		var stored = new(activityToken)
+		if err := json.Unmarshal(data, stored); err != nil {
+			return err
+		}
+		user, token = stored.User, stored.Token
+		return nil
+	})
+	return
+}
+
+// RemoveActivity удаляет токен Live Activity с указанным идентификатором.
+func (s *Store) RemoveActivity(topic, activity string, sandbox bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucketName("activities", topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(activity))
+	})
+}
+
+// GetTokensPage возвращает до limit токенов темы, следующих по порядку после
+// токена after. Если after пустой, то токены возвращаются с начала.
+func (s *Store) GetTokensPage(topic string, sandbox bool, after string, limit int) ([]string, error) {
+	var list = make([]string, 0, limit)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName(topic, sandbox))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		var k []byte
+		if after == "" {
+			k, _ = cursor.First()
+		} else {
+			k, _ = cursor.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, _ = cursor.Next()
+			}
+		}
+		for ; k != nil && len(list) < limit; k, _ = cursor.Next() {
+			list = append(list, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CountTokens возвращает количество зарегистрированных токенов темы.
+func (s *Store) CountTokens(topic string, sandbox bool) (count int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(bucketName(topic, sandbox)); bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// jobsBucket задает имя раздела хранилища с фоновыми задачами.
+var jobsBucket = []byte(":jobs")
+
+// SaveJob сохраняет состояние фоновой задачи.
+func (s *Store) SaveJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(job.ID), data)
+	})
+}
+
+// GetJob возвращает состояние фоновой задачи с указанным идентификатором.
+// Если задача не найдена, то возвращается nil.
+func (s *Store) GetJob(id string) (job *Job, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		job = new(Job)
+		return json.Unmarshal(data, job)
+	})
+	return
+}
+
+// GetJobs возвращает список всех сохраненных фоновых задач.
+func (s *Store) GetJobs() ([]*Job, error) {
+	var list = make([]*Job, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var job = new(Job)
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			list = append(list, job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// deliveriesBucket задает имя раздела хранилища с журналом доставки событий.
+var deliveriesBucket = []byte(":webhooks")
+
+// SaveDelivery сохраняет доставку события в журнале. Новой доставке
+// присваивается следующий по порядку идентификатор, а самые старые записи
+// сверх WebhookLogSize удаляются, кроме еще не доставленных.
+func (s *Store) SaveDelivery(delivery *Delivery) error {
+	return s.SaveDeliveries(delivery)
+}
+
+// SaveDeliveries сохраняет доставки событий в журнале за одну транзакцию так
+// же, как SaveDelivery.
+func (s *Store) SaveDeliveries(deliveries ...*Delivery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if err := putDelivery(bucket, delivery); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putDelivery сохраняет доставку события в разделе журнала.
+func putDelivery(bucket *bolt.Bucket, delivery *Delivery) error {
+	if delivery.ID == "" {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		delivery.ID = fmt.Sprintf("%016x", seq)
+		// удаляем записи, не попадающие в журнал, кроме ожидающих доставки
+		if WebhookLogSize > 0 && seq > uint64(WebhookLogSize) {
+			last := []byte(fmt.Sprintf("%016x", seq-uint64(WebhookLogSize)))
+			var keys [][]byte
+			cursor := bucket.Cursor()
+			for k, v := cursor.First(); k != nil && bytes.Compare(k, last) <= 0; k, v = cursor.Next() {
+				var old Delivery
+				if err := json.Unmarshal(v, &old); err != nil {
+					return err
+				}
+				if old.Status != DeliveryPending {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+			}
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(delivery.ID), data)
+}
+
+// GetDelivery возвращает доставку события с указанным идентификатором. Если
+// она не найдена, то возвращается nil.
+func (s *Store) GetDelivery(id string) (delivery *Delivery, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		delivery = new(Delivery)
+		return json.Unmarshal(data, delivery)
+	})
+	return
+}
+
+// GetDeliveries возвращает доставки из журнала, для которых filter возвращает
+// true, от новых к старым. Если limit больше нуля, то он ограничивает размер
+// списка.
+func (s *Store) GetDeliveries(limit int, filter func(*Delivery) bool) (
+	[]*Delivery, error) {
+	var list = make([]*Delivery, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var delivery = new(Delivery)
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return err
+			}
+			if filter != nil && !filter(delivery) {
+				continue
+			}
+			list = append(list, delivery)
+			if limit > 0 && len(list) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Разделы хранилища с ключами идемпотентности и индексом по времени их
+// устаревания.
+var (
+	idempotencyBucket        = []byte(":idempotency")
+	idempotencyExpiresBucket = []byte(":idempotency:expires")
+)
+
+// idempotencyIndexKey возвращает ключ индекса устаревания: время в
+// наносекундах, за которым следует ключ идемпотентности.
+func idempotencyIndexKey(key string, expires time.Time) []byte {
+	var index = make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(index, uint64(expires.UnixNano()))
+	copy(index[8:], key)
+	return index
+}
+
+// BeginIdempotent сохраняет запись о начале выполнения запроса с ключом
+// идемпотентности. Если для ключа уже есть действующая запись, то она
+// возвращается без изменений. Запись незавершенного запроса, начатого раньше
+// idempotencyLockTimeout, считается прерванной и заменяется. Устаревшие
+// записи удаляются.
+func (s *Store) BeginIdempotent(key string, record *IdempotencyRecord) (
+	stored *IdempotencyRecord, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists(idempotencyExpiresBucket)
+		if err != nil {
+			return err
+		}
+		// удаляем устаревшие записи
+		var now = uint64(time.Now().UnixNano())
+		cursor := index.Cursor()
+		for k, _ := cursor.First(); k != nil &&
+			binary.BigEndian.Uint64(k[:8]) <= now; k, _ = cursor.First() {
+			if err := bucket.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+		}
+		if data := bucket.Get([]byte(key)); data != nil {
+			var current = new(IdempotencyRecord)
+			if err := json.Unmarshal(data, current); err != nil {
+				return err
+			}
+			if current.Status != 0 ||
+				time.Since(current.Created) < idempotencyLockTimeout {
+				stored = current
+				return nil
+			}
+			// незавершенный запрос прерван: заменяем запись
+			err = index.Delete(idempotencyIndexKey(key, current.Expires))
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(key), data); err != nil {
+			return err
+		}
+		return index.Put(idempotencyIndexKey(key, record.Expires), nil)
+	})
+	return
+}
+
+// CompleteIdempotent сохраняет ответ на запрос с ключом идемпотентности.
+func (s *Store) CompleteIdempotent(key string, record *IdempotencyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+// RemoveIdempotent удаляет запись о запросе с ключом идемпотентности.
+func (s *Store) RemoveIdempotent(key string, record *IdempotencyRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(idempotencyBucket); bucket != nil {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if index := tx.Bucket(idempotencyExpiresBucket); index != nil {
+			return index.Delete(idempotencyIndexKey(key, record.Expires))
+		}
+		return nil
+	})
+}
+
+// usageBucket задает имя раздела хранилища со счетчиками отправленных
+// уведомлений. Ключи счетчиков начинаются с месяца в формате 2006-01.
+var usageBucket = []byte(":usage")
+
+// AddUsage изменяет счетчики отправленных уведомлений за месяц на count.
+func (s *Store) AddUsage(month string, count int64, keys ...string) error {
+	if count == 0 || len(keys) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			var name = []byte(month + "/" + key)
+			var value = make([]byte, 8)
+			var used = count
+			if data := bucket.Get(name); len(data) == 8 {
+				used += int64(binary.BigEndian.Uint64(data))
+			}
+			binary.BigEndian.PutUint64(value, uint64(used))
+			if err := bucket.Put(name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReserveUsage добавляет count к счетчикам уведомлений за месяц, если ни один
+// из них не превысит свою квоту. Нулевая квота не ограничивает счетчик.
+// Возвращает false, если хотя бы одной квоты не хватает.
+func (s *Store) ReserveUsage(month string, count int64, quotas map[string]int64) (
+	ok bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		var used = make(map[string]int64, len(quotas))
+		for key, quota := range quotas {
+			if data := bucket.Get([]byte(month + "/" + key)); len(data) == 8 {
+				used[key] = int64(binary.BigEndian.Uint64(data))
+			}
+			if quota > 0 && used[key]+count > quota {
+				return nil
+			}
+		}
+		for key := range quotas {
+			var value = make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(used[key]+count))
+			if err := bucket.Put([]byte(month+"/"+key), value); err != nil {
+				return err
+			}
+		}
+		ok = true
+		return nil
+	})
+	return ok, err
+}
+
+// GetUsage возвращает счетчики отправленных уведомлений за месяц.
+func (s *Store) GetUsage(month string) (map[string]int64, error) {
+	var usage = make(map[string]int64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket == nil {
+			return nil
+		}
+		var prefix = []byte(month + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if len(v) == 8 {
+				usage[string(k[len(prefix):])] = int64(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// scheduleBucket задает имя раздела хранилища с уведомлениями, отложенными до
+// указанного времени. Ключ состоит из времени отправки в наносекундах и
+// порядкового номера, поэтому записи упорядочены по времени отправки.
+var scheduleBucket = []byte(":schedule")
+
+// SaveScheduled сохраняет отложенное уведомление и присваивает ему
+// идентификатор.
+func (s *Store) SaveScheduled(push *ScheduledPush) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(scheduleBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key = make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(push.At.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		push.ID = hex.EncodeToString(key)
+		data, err := json.Marshal(push)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+// GetScheduled возвращает отложенные уведомления со временем отправки не
+// позднее указанного в порядке времени отправки, но не больше limit.
+func (s *Store) GetScheduled(before time.Time, limit int) ([]*ScheduledPush, error) {
+	var list = make([]*ScheduledPush, 0)
+	var last = uint64(before.UnixNano())
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduleBucket)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil && len(list) < limit; k, v = cursor.Next() {
+			if len(k) != 16 || binary.BigEndian.Uint64(k) > last {
+				break
+			}
+			var push = new(ScheduledPush)
+			if err := json.Unmarshal(v, push); err != nil {
+				return err
+			}
+			list = append(list, push)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// NextScheduled возвращает время отправки ближайшего отложенного уведомления.
+// Если отложенных уведомлений нет, то возвращается нулевое время.
+func (s *Store) NextScheduled() (next time.Time, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduleBucket)
+		if bucket == nil {
+			return nil
+		}
+		if k, _ := bucket.Cursor().First(); len(k) == 16 {
+			next = time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+		}
+		return nil
+	})
+	return
+}
+
+// RemoveScheduled удаляет отложенное уведомление.
+func (s *Store) RemoveScheduled(id string) error {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduleBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// historyKey возвращает ключ уведомления в истории пользователя.
+func historyKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%016x", seq))
+}
+
+// NextHistoryID возвращает новый идентификатор уведомления в истории темы.
+// Идентификаторы общие для всех пользователей темы, поэтому уведомление,
+// отправленное по одному запросу, сохраняется у них с одним идентификатором.
+func (s *Store) NextHistoryID(topic string, sandbox bool) (id string, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(
+			dataBucketName("history", topic, sandbox))
+		if err != nil {
+			return err
+		}
+		seq, err := root.NextSequence()
+		if err != nil {
+			return err
+		}
+		id = string(historyKey(seq))
+		return nil
+	})
+	return
+}
+
+// AddHistory сохраняет уведомление в истории пользователя. Если у
+// уведомления нет идентификатора, то он присваивается так же, как в
+// NextHistoryID. Уведомления старше maxAge и самые старые уведомления сверх
+// maxCount удаляются.
+func (s *Store) AddHistory(topic string, sandbox bool, user string,
+	item *HistoryItem, maxAge time.Duration, maxCount int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(
+			dataBucketName("history", topic, sandbox))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		if item.ID == "" {
+			seq, err := root.NextSequence()
+			if err != nil {
+				return err
+			}
+			item.ID = string(historyKey(seq))
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(item.ID), data); err != nil {
+			return err
+		}
+		// удаляем устаревшие уведомления, начиная с самых старых
+		var count int
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			count++
+		}
+		var since = item.Created.Add(-maxAge)
+		for k, v := cursor.First(); k != nil; k, v = cursor.First() {
+			var stored HistoryItem
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			if count <= maxCount && stored.Created.After(since) {
+				break
+			}
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			count--
+		}
+		return nil
+	})
+}
+
+// GetHistory возвращает уведомления из истории пользователя, для которых
+// filter возвращает true, от новых к старым. Если before не пустой, то
+// возвращаются только уведомления, сохраненные раньше уведомления с этим
+// идентификатором. Размер списка ограничен limit.
+func (s *Store) GetHistory(topic string, sandbox bool, user, before string,
+	limit int, filter func(*HistoryItem) bool) ([]*HistoryItem, error) {
+	var list = make([]*HistoryItem, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(dataBucketName("history", topic, sandbox))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(user))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		var k, v []byte
+		if before == "" {
+			k, v = cursor.Last()
+		} else if k, v = cursor.Seek([]byte(before)); k == nil {
+			k, v = cursor.Last()
+		} else {
+			k, v = cursor.Prev() // before в список не входит
+		}
+		for ; k != nil && len(list) < limit; k, v = cursor.Prev() {
+			var item = new(HistoryItem)
+			if err := json.Unmarshal(v, item); err != nil {
+				return err
+			}
+			if filter == nil || filter(item) {
+				list = append(list, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// MarkHistory отмечает уведомление из истории пользователя прочитанным или
+// непрочитанным и возвращает количество найденных уведомлений. Если id
+// пустой, то отмечаются все уведомления пользователя.
+func (s *Store) MarkHistory(topic string, sandbox bool, user, id string,
+	read bool) (count int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(dataBucketName("history", topic, sandbox))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(user))
+		if bucket == nil {
+			return nil
+		}
+		// mark изменяет отметку о прочтении уведомления
+		mark := func(k, v []byte) error {
+			var item = new(HistoryItem)
+			if err := json.Unmarshal(v, item); err != nil {
+				return err
+			}
+			count++
+			if item.Read == read {
+				return nil
+			}
+			item.Read = read
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(k, data)
+		}
+		if id != "" {
+			if data := bucket.Get([]byte(id)); data != nil {
+				return mark([]byte(id), data)
+			}
+			return nil
+		}
+		// изменять раздел при обходе ForEach нельзя, поэтому собираем ключи
+		var keys [][]byte
+		if err := bucket.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := mark(k, bucket.Get(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// SetHistoryStatus изменяет статус отправки уведомления из истории
+// пользователя на токен устройства. Если уведомление не найдено, то ничего
+// не изменяется.
+func (s *Store) SetHistoryStatus(topic string, sandbox bool, user, id, token,
+	status string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(dataBucketName("history", topic, sandbox))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(user))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var item = new(HistoryItem)
+		if err := json.Unmarshal(data, item); err != nil {
+			return err
+		}
+		if item.Devices == nil {
+			item.Devices = make(map[string]string)
+		}
+		item.Devices[token] = status
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+// RemoveHistory удаляет уведомление из истории пользователя.
+func (s *Store) RemoveHistory(topic string, sandbox bool, user, id string) (
+	exist bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(dataBucketName("history", topic, sandbox))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(user))
+		if bucket == nil || bucket.Get([]byte(id)) == nil {
+			return nil
+		}
+		exist = true
+		return bucket.Delete([]byte(id))
+	})
+	return
+}
+
+// topicBucket возвращает тему и флаг sandbox для имени раздела хранилища с
+// токенами устройств. Для разделов с другими данными возвращается false.
+func topicBucket(name []byte) (topic string, sandbox, ok bool) {
+	if len(name) == 0 || bytes.IndexByte(name, ':') >= 0 {
+		return "", false, false
+	}
+	if name[0] == '~' {
+		return string(name[1:]), true, true
+	}
+	return string(name), false, true
+}
+
+// TokenInfo описывает токен устройства в хранилище.
+type TokenInfo struct {
+	Token   string    `json:"token"`
+	Topic   string    `json:"topic"`
+	Sandbox bool      `json:"sandbox,omitempty"`
+	User    string    `json:"user"`
+	Added   time.Time `json:"added"`
+}
+
+// FindToken возвращает сведения о токене устройства во всех темах.
+func (s *Store) FindToken(token string) ([]*TokenInfo, error) {
+	var list = make([]*TokenInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			topic, sandbox, ok := topicBucket(name)
+			if !ok {
+				return nil
+			}
+			if data := bucket.Get([]byte(token)); data != nil {
+				added, user := timeAndName(data)
+				list = append(list, &TokenInfo{
+					Token:   token,
+					Topic:   topic,
+					Sandbox: sandbox,
+					User:    user,
+					Added:   added,
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetTopicTokens возвращает сведения о всех токенах темы указанного вида.
+func (s *Store) GetTopicTokens(kind, topic string, sandbox bool) ([]*TokenInfo, error) {
+	name, err := tokenBucketName(kind, topic, sandbox)
+	if err != nil {
+		return nil, err
+	}
+	var list = make([]*TokenInfo, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			added, user := timeAndName(v)
+			list = append(list, &TokenInfo{
+				Token:   string(k),
+				Topic:   topic,
+				Sandbox: sandbox,
+				User:    user,
+				Added:   added,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// TopicStats описывает количество токенов устройств и их пользователей темы.
+type TopicStats struct {
+	Topic   string `json:"topic"`
+	Sandbox bool   `json:"sandbox,omitempty"`
+	Tokens  int    `json:"tokens"`
+	Users   int    `json:"users"`
+}
+
+// GetTopicsStats возвращает количество токенов устройств и пользователей для
+// всех тем в хранилище.
+func (s *Store) GetTopicsStats() ([]*TopicStats, error) {
+	var list = make([]*TopicStats, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			topic, sandbox, ok := topicBucket(name)
+			if !ok {
+				return nil
+			}
+			var (
+				stats = &TopicStats{Topic: topic, Sandbox: sandbox}
+				users = make(map[string]struct{})
+			)
+			bucket.ForEach(func(k, v []byte) error {
+				_, user := timeAndName(v)
+				users[user] = struct{}{}
+				stats.Tokens++
+				return nil
+			})
+			stats.Users = len(users)
+			list = append(list, stats)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CountScheduled возвращает количество уведомлений в расписании.
+func (s *Store) CountScheduled() (count int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(scheduleBucket); bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// MarshalJSON возвращает путь к хранилищу в виде строки JSON.
+func (s *Store) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.db.Path())
+}
+
+// UnmarshalJSON получает путь к хранилищу из строки JSON и открывает его как
+// хранилище токенов устройств.
+func (s *Store) UnmarshalJSON(data []byte) error {
+	var path string
+	err := json.Unmarshal(data, &path)
+	if err != nil {
+		return err
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+	store, err := bolt.Open(path, 0600, boltOptions)
+	if err != nil {
+		return err
+	}
+	s.db = store
+	return nil
+}
+
+// Check проверяет доступность хранилища, открывая транзакцию на чтение.
+func (s *Store) Check() error {
+	if s == nil || s.db == nil {
+		return errors.New("store not opened")
+	}
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	return tx.Rollback()
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// токен зарегистрирован только как VoIP и Live Activity, без раздела
+	// токенов устройств темы
+	for _, err := range []error{
+		store.SaveToken(TokenVoIP, "dmitrys", testTopic, "AAAA", false),
+		store.SetTokenTags(testTopic, "AAAA", false, []string{"beta"}),
+		store.SavePushToStartToken("dmitrys", testTopic, "AAAA", false),
+		store.SaveActivityToken("dmitrys", testTopic, "match", "AAAA", false),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Remove("AAAA", testTopic, time.Now(), false); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err := store.GetUserTokens(TokenVoIP, testTopic, false, "dmitrys"); err != nil ||
+		len(tokens) != 0 {
+		t.Errorf("voip tokens: %v, %v", tokens, err)
+	}
+	if tags, err := store.GetTokenTags(testTopic, "AAAA", false); err != nil || len(tags) != 0 {
+		t.Errorf("tags: %v, %v", tags, err)
+	}
+	if tokens, err := store.GetPushToStartTokens(testTopic, false, "dmitrys"); err != nil ||
+		len(tokens) != 0 {
+		t.Errorf("push to start tokens: %v, %v", tokens, err)
+	}
+	if _, token, err := store.GetActivityToken(testTopic, "match", false); err != nil ||
+		token != "" {
+		t.Errorf("activity token: %q, %v", token, err)
+	}
+}
+
+func TestStoreTokenMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// повторная регистрация только с языком сохраняет зону времени
+	for _, meta := range []*TokenMeta{
+		{Locale: "de-AT", TimeZone: "Europe/Vienna"},
+		{Locale: "fr"},
+	} {
+		if err := store.SetTokenMeta(testTopic, "AAAA", false, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, err := store.GetTokensMeta(testTopic, false, "AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["AAAA"] == nil || *meta["AAAA"] != (TokenMeta{"fr", "Europe/Vienna"}) {
+		t.Errorf("meta: %+v", meta["AAAA"])
+	}
+}
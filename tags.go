@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mdigger/rest"
+)
+
+// tagsRequest описывает запрос на установку тегов.
+type tagsRequest struct {
+	Tags []string `json:"tags" form:"tag"`
+}
+
+// GetUserTags отдает список тегов пользователя.
+func (s *Service) GetUserTags(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	tags, err := s.config.Store.GetUserTags(topic, user)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"tags": tags})
+}
+
+// SetUserTags заменяет список тегов пользователя.
+func (s *Service) SetUserTags(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	var request = new(tagsRequest)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	tags := normalizeTags(request.Tags)
+	if err := s.config.Store.SetUserTags(topic, user, tags); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"tags": tags})
+}
+
+// GetTokenTags отдает список тегов токена устройства.
+func (s *Service) GetTokenTags(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	token := c.Param("token") // токен устройства
+	if token == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	tags, err := s.config.Store.GetTokenTags(topic, token, sandbox)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"tags": tags})
+}
+
+// SetTokenTags заменяет список тегов токена устройства.
+func (s *Service) SetTokenTags(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	token := c.Param("token") // токен устройства
+	if token == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return rest.ErrNotFound
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	var request = new(tagsRequest)
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+	// теги сохраняются только для зарегистрированных токенов
+	users, err := s.config.Store.GetTokensUsers(topic, sandbox, token)
+	if err != nil {
+		return err
+	}
+	if _, ok := users[token]; !ok {
+		return c.Error(http.StatusNotFound, "token not registered")
+	}
+	tags := normalizeTags(request.Tags)
+	if err := s.config.Store.SetTokenTags(topic, token, sandbox, tags); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"tags": tags})
+}
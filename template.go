@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mdigger/rest"
+)
+
+// Template описывает именованный шаблон уведомления с вариантами для разных
+// языков. Строковые значения вариантов могут содержать подстановки вида
+// {{name}}, которые заменяются значениями переменных из запроса.
+type Template struct {
+	Name    string                      `json:"name"`
+	Default string                      `json:"default,omitempty"` // язык по умолчанию
+	Locales map[string]*TemplateVariant `json:"locales"`
+}
+
+// TemplateVariant описывает вариант шаблона для одного языка.
+type TemplateVariant struct {
+	Alert   *Alert                 `json:"alert,omitempty"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+// templateVar описывает подстановку переменной в шаблоне.
+var templateVar = regexp.MustCompile(`{{\s*([^{}\s]+)\s*}}`)
+
+// Validate проверяет корректность шаблона.
+func (t *Template) Validate() error {
+	if len(t.Locales) == 0 {
+		return PayloadError("template has no locales")
+	}
+	if t.Default != "" && t.Locales[t.Default] == nil {
+		return PayloadError(fmt.Sprintf(
+			"template default locale %q not defined", t.Default))
+	}
+	for locale, variant := range t.Locales {
+		if variant == nil || (variant.Alert == nil && len(variant.Payload) == 0) {
+			return PayloadError(fmt.Sprintf(
+				"template locale %q is empty", locale))
+		}
+		if variant.Alert != nil {
+			if err := variant.Alert.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// variant возвращает вариант шаблона для указанного языка. Если точного
+// совпадения нет, то используется вариант для основного языка (de для de-AT),
+// затем вариант по умолчанию, а если он не задан и вариант только один, то
+// он.
+func (t *Template) variant(locale string) (*TemplateVariant, error) {
+	if variant, ok := t.Locales[locale]; ok {
+		return variant, nil
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if variant, ok := t.Locales[locale[:i]]; ok {
+			return variant, nil
+		}
+	}
+	if variant, ok := t.Locales[t.Default]; ok {
+		return variant, nil
+	}
+	if len(t.Locales) == 1 {
+		for _, variant := range t.Locales {
+			return variant, nil
+		}
+	}
+	return nil, fmt.Errorf("template %s has no variant for locale %q",
+		t.Name, locale)
+}
+
+// Render возвращает содержимое уведомления для указанного языка с
+// подставленными значениями переменных.
+func (t *Template) Render(locale string, vars map[string]interface{}) (
+	alert *Alert, payload map[string]interface{}, err error) {
+	variant, err := t.variant(locale)
+	if err != nil {
+		return nil, nil, err
+	}
+	// переводим вариант в универсальное представление для подстановок
+	data, err := json.Marshal(variant)
+	if err != nil {
+		return nil, nil, err
+	}
+	var value interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return nil, nil, err
+	}
+	if value, err = renderValue(value, vars); err != nil {
+		return nil, nil, err
+	}
+	if data, err = json.Marshal(value); err != nil {
+		return nil, nil, err
+	}
+	var rendered = new(TemplateVariant)
+	if err = json.Unmarshal(data, rendered); err != nil {
+		return nil, nil, err
+	}
+	return rendered.Alert, rendered.Payload, nil
+}
+
+// renderValue рекурсивно заменяет подстановки во всех строковых значениях.
+func renderValue(value interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return renderString(value, vars)
+	case []interface{}:
+		for i, item := range value {
+			rendered, err := renderValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = rendered
+		}
+		return value, nil
+	case map[string]interface{}:
+		for key, item := range value {
+			rendered, err := renderValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = rendered
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
+
+// renderString заменяет подстановки в строке значениями переменных.
+func renderString(text string, vars map[string]interface{}) (string, error) {
+	var err error
+	text = templateVar.ReplaceAllStringFunc(text, func(match string) string {
+		name := templateVar.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("template variable %q not defined", name)
+			}
+			return match
+		}
+		return fmt.Sprint(value)
+	})
+	return text, err
+}
+
+// templateVars возвращает переменные для подстановки в шаблон для
+// пользователя: встроенные user и locale, общие переменные запроса и
+// переменные пользователя.
+func templateVars(user, locale string, vars map[string]interface{},
+	userVars map[string]map[string]interface{}) map[string]interface{} {
+	var result = map[string]interface{}{
+		"user":   user,
+		"locale": locale,
+	}
+	for name, value := range vars {
+		result[name] = value
+	}
+	for name, value := range userVars[user] {
+		result[name] = value
+	}
+	return result
+}
+
+// pushTemplate отправляет уведомление по шаблону, отдельно формируя его для
+// каждого токена с учетом языка устройства и переменных пользователя. Ошибки
+// формирования уведомления возвращаются в статусе отправки для токена.
+func (s *Service) pushTemplate(request *pushRequest, topic string,
+	sandbox bool, tokens []string, state *deliveryState) (map[string]string, error) {
+	template, err := s.config.Store.GetTemplate(topic, request.Template)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		return nil, PayloadError(
+			fmt.Sprintf("template %s not found", request.Template))
+	}
+	users, err := s.config.Store.GetTokensUsers(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.config.Store.GetTokensMeta(topic, sandbox, tokens...)
+	if err != nil {
+		return nil, err
+	}
+	var sent = make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		var locale string
+		if meta[token] != nil {
+			locale = meta[token].Locale
+		}
+		var user = users[token]
+		alert, payload, err := template.Render(locale,
+			templateVars(user, locale, request.Vars, request.UserVars))
+		if err != nil {
+			sent[token] = err.Error()
+			continue
+		}
+		var rendered = *request
+		rendered.Alert, rendered.Payload = alert, payload
+		n, err := rendered.Notification(topic, sandbox)
+		if err != nil {
+			sent[token] = err.Error()
+			continue
+		}
+		status, err := s.pushTokens(n, []string{token}, state)
+		for token, value := range status {
+			sent[token] = value
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// GetTemplates отдает список имен шаблонов уведомлений темы.
+func (s *Service) GetTemplates(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	list, err := s.config.Store.GetTemplates(c.Param("topic"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(list)
+	return c.Write(rest.JSON{"templates": list})
+}
+
+// GetTemplate отдает шаблон уведомления.
+func (s *Service) GetTemplate(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	var name = c.Param("name")
+	template, err := s.config.Store.GetTemplate(c.Param("topic"), name)
+	if err != nil {
+		return err
+	}
+	if template == nil {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("template %s not found", name))
+	}
+	return c.Write(rest.JSON{"template": template})
+}
+
+// SetTemplate сохраняет шаблон уведомления.
+func (s *Service) SetTemplate(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	var template = new(Template)
+	if err := c.Bind(template); err != nil {
+		return err
+	}
+	template.Name = c.Param("name")
+	if err := template.Validate(); err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	exist, err := s.config.Store.GetTemplate(topic, template.Name)
+	if err != nil {
+		return err
+	}
+	if err := s.config.Store.SaveTemplate(topic, template); err != nil {
+		return err
+	}
+	if exist == nil {
+		c.SetStatus(http.StatusCreated)
+	}
+	return c.Write(rest.JSON{"template": template})
+}
+
+// RemoveTemplate удаляет шаблон уведомления.
+func (s *Service) RemoveTemplate(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	var topic, name = c.Param("topic"), c.Param("name")
+	exist, err := s.config.Store.RemoveTemplate(topic, name)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("template %s not found", name))
+	}
+	list, err := s.config.Store.GetTemplates(topic)
+	if err != nil {
+		return err
+	}
+	sort.Strings(list)
+	return c.Write(rest.JSON{"templates": list})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTemplateVariant(t *testing.T) {
+	var template = &Template{
+		Name:    "welcome",
+		Default: "en",
+		Locales: map[string]*TemplateVariant{
+			"en":    {Alert: &Alert{Body: "Hello"}},
+			"de":    {Alert: &Alert{Body: "Hallo"}},
+			"de-AT": {Alert: &Alert{Body: "Servus"}},
+		},
+	}
+	for locale, body := range map[string]string{
+		"de-AT": "Servus", // точное совпадение
+		"de-CH": "Hallo",  // основной язык
+		"de_DE": "Hallo",
+		"fr":    "Hello", // язык по умолчанию
+		"":      "Hello",
+	} {
+		variant, err := template.variant(locale)
+		if err != nil || variant.Alert.Body != body {
+			t.Errorf("%q: %+v, %v", locale, variant, err)
+		}
+	}
+	// без языка по умолчанию используется единственный вариант
+	template.Default = ""
+	if _, err := template.variant("fr"); err == nil {
+		t.Error("variant without default locale")
+	}
+	template.Locales = map[string]*TemplateVariant{"de": template.Locales["de"]}
+	if variant, err := template.variant("fr"); err != nil || variant.Alert.Body != "Hallo" {
+		t.Errorf("single variant: %+v, %v", variant, err)
+	}
+}
+
+func TestPushTemplate(t *testing.T) {
+	ts := newTestService(t)
+	var path = "/apns/" + testTopic
+	// регистрируем токены устройств с разными языками
+	for token, locale := range map[string]string{
+		"AAAA": "de-AT",
+		"BBBB": "de-CH",
+		"CCCC": "fr",
+		"DDDD": "",
+	} {
+		ts.expect(http.StatusCreated, "POST", path+"/users/dmitrys",
+			map[string]string{"token": token, "locale": locale})
+	}
+	ts.expect(http.StatusCreated, "PUT", path+"/templates/welcome", map[string]interface{}{
+		"default": "en",
+		"locales": map[string]interface{}{
+			"en":    map[string]interface{}{"alert": map[string]string{"body": "Hello, {{name}}"}},
+			"de":    map[string]interface{}{"alert": map[string]string{"body": "Hallo, {{name}}"}},
+			"de-AT": map[string]interface{}{"alert": map[string]string{"body": "Servus, {{name}} ({{locale}})"}},
+		},
+	})
+	var result struct {
+		Sent map[string]string `json:"sent"`
+	}
+	ts.expect(http.StatusOK, "POST", path+"/users/dmitrys/push", map[string]interface{}{
+		"template": "welcome",
+		"vars":     map[string]string{"name": "World"},
+		"userVars": map[string]interface{}{"dmitrys": map[string]string{"name": "Dmitry"}},
+	}).Decode(t, &result)
+	if len(result.Sent) != 4 {
+		t.Fatalf("sent: %v", result.Sent)
+	}
+	var bodies = make(map[string]string)
+	for _, req := range ts.apns.Requests() {
+		var payload struct {
+			Aps struct {
+				Alert struct {
+					Body string `json:"body"`
+				} `json:"alert"`
+			} `json:"aps"`
+		}
+		if err := json.Unmarshal(req.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		bodies[req.Token] = payload.Aps.Alert.Body
+	}
+	for token, body := range map[string]string{
+		"AAAA": "Servus, Dmitry (de-AT)",
+		"BBBB": "Hallo, Dmitry",
+		"CCCC": "Hello, Dmitry",
+		"DDDD": "Hello, Dmitry",
+	} {
+		if bodies[token] != body {
+			t.Errorf("%s: %q, want %q", token, bodies[token], body)
+		}
+	}
+	// неизвестный шаблон
+	ts.expect(http.StatusBadRequest, "POST", path+"/users/dmitrys/push",
+		map[string]interface{}{"template": "unknown"})
+}
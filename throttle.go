@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// StatusThrottled — статус отправки уведомления, отложенного из-за частой
+// отправки на тот же токен устройства.
+const StatusThrottled = "throttled"
+
+// ThrottleConfig описывает ограничение количества уведомлений на один токен
+// устройства за интервал времени.
+type ThrottleConfig struct {
+	Window Duration `json:"window,omitempty"` // интервал, по умолчанию 10s
+	Max    int      `json:"max,omitempty"`    // уведомлений, по умолчанию 1
+}
+
+const (
+	defaultThrottleWindow = 10 * time.Second
+	maxHeldNotifications  = 100 // отложенных уведомлений на один токен
+)
+
+// tokenThrottle отслеживает недавние отправки на токены устройств и
+// откладывает уведомления сверх ограничения. Отложенные уведомления
+// сохраняются в расписании, поэтому отправляются и после перезапуска сервиса.
+// Отложенное уведомление с collapseId заменяет ранее отложенное с тем же
+// collapseId, остальные отправляются по очереди.
+type tokenThrottle struct {
+	config *Config
+	window time.Duration
+	max    int
+	sent   map[string][]time.Time // время недавних отправок на токен
+	held   map[string][]heldPush  // отложенные уведомления токена
+	sweep  *time.Timer            // таймер удаления устаревших отправок
+	closed bool
+	mu     sync.Mutex
+}
+
+// heldPush описывает уведомление, отложенное в расписании.
+type heldPush struct {
+	id         string    // идентификатор в расписании
+	collapseID string    // заголовок apns-collapse-id
+	at         time.Time // время отправки
+}
+
+// newTokenThrottle возвращает ограничитель отправки на токены по настройкам
+// из конфигурации.
+func newTokenThrottle(config *Config) *tokenThrottle {
+	var throttle = &tokenThrottle{
+		config: config,
+		window: time.Duration(config.Throttle.Window),
+		max:    config.Throttle.Max,
+		sent:   make(map[string][]time.Time),
+		held:   make(map[string][]heldPush),
+	}
+	if throttle.window <= 0 {
+		throttle.window = defaultThrottleWindow
+	}
+	if throttle.max < 1 {
+		throttle.max = 1
+	}
+	return throttle
+}
+
+// throttleKey возвращает ключ токена с учетом темы и окружения.
+func throttleKey(notification *Notification) string {
+	return string(bucketName(notification.Topic, notification.Sandbox)) +
+		"/" + notification.Token
+}
+
+// Allow возвращает true и учитывает отправку, если уведомление на токен можно
+// отправить сейчас. Иначе уведомление откладывается до освобождения
+// интервала.
+func (t *tokenThrottle) Allow(notification Notification) bool {
+	var key = throttleKey(&notification)
+	var now = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent := t.recent(key, now)
+	if len(sent) < t.max {
+		t.sent[key] = append(sent, now)
+		if t.sweep == nil && !t.closed {
+			t.sweep = time.AfterFunc(t.window, t.clean)
+		}
+		return true
+	}
+	t.hold(key, &notification, sent[0].Add(t.window).Sub(now))
+	return false
+}
+
+// Hold откладывает уведомление на интервал ограничения, например, после
+// ответа APNS TooManyRequests.
+func (t *tokenThrottle) Hold(notification Notification) {
+	t.mu.Lock()
+	t.hold(throttleKey(&notification), &notification, t.window)
+	t.mu.Unlock()
+}
+
+// recent возвращает время отправок на токен в пределах интервала.
+// Вызывается с блокировкой.
+func (t *tokenThrottle) recent(key string, now time.Time) []time.Time {
+	sent := t.sent[key]
+	var i int
+	for i < len(sent) && now.Sub(sent[i]) >= t.window {
+		i++
+	}
+	sent = sent[i:]
+	if len(sent) == 0 {
+		delete(t.sent, key)
+	}
+	return sent
+}
+
+// clean удаляет время отправок, вышедшее за пределы интервала, и
+// отправленные отложенные уведомления для всех токенов. Пока они остаются,
+// очистка повторяется через интервал ограничения.
+func (t *tokenThrottle) clean() {
+	var now = time.Now()
+	t.mu.Lock()
+	for key := range t.sent {
+		if sent := t.recent(key, now); len(sent) > 0 {
+			t.sent[key] = sent
+		}
+	}
+	for key := range t.held {
+		t.pending(key, now)
+	}
+	t.sweep = nil
+	if (len(t.sent) > 0 || len(t.held) > 0) && !t.closed {
+		t.sweep = time.AfterFunc(t.window, t.clean)
+	}
+	t.mu.Unlock()
+}
+
+// pending возвращает отложенные уведомления токена, время отправки которых
+// еще не наступило. Вызывается с блокировкой.
+func (t *tokenThrottle) pending(key string, now time.Time) []heldPush {
+	held := t.held[key]
+	var i int
+	for i < len(held) && !held[i].at.After(now) {
+		i++
+	}
+	held = held[i:]
+	if len(held) == 0 {
+		delete(t.held, key)
+	} else {
+		t.held[key] = held
+	}
+	return held
+}
+
+// hold сохраняет уведомление в расписании для отправки через delay.
+// Вызывается с блокировкой.
+func (t *tokenThrottle) hold(key string, notification *Notification, delay time.Duration) {
+	ctxlog := log.WithFields(log.Fields{
+		"token": notification.Token,
+		"topic": notification.Topic,
+	})
+	var now = time.Now()
+	held := t.pending(key, now)
+	// remove удаляет ранее отложенное уведомление из расписания
+	remove := func(i int) {
+		if err := t.config.Store.RemoveScheduled(held[i].id); err != nil {
+			ctxlog.WithError(err).Error("remove throttled push error")
+		}
+		held = append(held[:i], held[i+1:]...)
+	}
+	// уведомление с тем же collapseId заменяет отложенное ранее
+	if notification.CollapseID != "" {
+		for i, item := range held {
+			if item.collapseID == notification.CollapseID {
+				remove(i)
+				break
+			}
+		}
+	}
+	if len(held) >= maxHeldNotifications {
+		ctxlog.Warning("too many throttled notifications: drop oldest")
+		remove(0)
+	}
+	// отложенные уведомления отправляются по очереди
+	var at = now.Add(delay)
+	if len(held) > 0 && held[len(held)-1].at.After(at) {
+		at = held[len(held)-1].at
+	}
+	id, err := t.config.schedule(at, notification)
+	if err != nil {
+		ctxlog.WithError(err).Error("throttled push error")
+	} else {
+		held = append(held, heldPush{
+			id:         id,
+			collapseID: notification.CollapseID,
+			at:         at,
+		})
+	}
+	if len(held) > 0 {
+		t.held[key] = held
+	} else {
+		delete(t.held, key)
+	}
+	if t.sweep == nil && !t.closed {
+		t.sweep = time.AfterFunc(t.window, t.clean)
+	}
+}
+
+// Close останавливает очистку недавних отправок. Отложенные уведомления
+// остаются в расписании.
+func (t *tokenThrottle) Close() {
+	t.mu.Lock()
+	t.closed = true
+	if t.sweep != nil {
+		t.sweep.Stop()
+		t.sweep = nil
+	}
+	t.mu.Unlock()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+func TestThrottle(t *testing.T) {
+	const window = 200 * time.Millisecond
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Throttle = &ThrottleConfig{Window: Duration(window)}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	var path = "/apns/" + testTopic + "/users/dmitrys/push"
+	// push отправляет уведомление с указанным текстом и collapseId
+	push := func(alert, collapseID string) string {
+		t.Helper()
+		resp := ts.expect(http.StatusOK, "POST", path, map[string]interface{}{
+			"payload":    map[string]interface{}{"aps": map[string]interface{}{"alert": alert}},
+			"collapseId": collapseID,
+		})
+		return sent(t, resp)["AAAA"]
+	}
+	// wait ожидает указанное количество запросов к APNS
+	wait := func(n int) []*mockapns.Request {
+		t.Helper()
+		for deadline := time.Now().Add(5 * window); time.Now().Before(deadline); {
+			if requests := ts.apns.Requests(); len(requests) >= n {
+				return requests
+			}
+			time.Sleep(window / 10)
+		}
+		requests := ts.apns.Requests()
+		t.Fatalf("apns requests: %d, want %d", len(requests), n)
+		return requests
+	}
+	if status := push("first", "chat"); status != "OK" {
+		t.Fatalf("first: %q", status)
+	}
+	// уведомления с тем же collapseId заменяют отложенное
+	for _, alert := range []string{"second", "third"} {
+		if status := push(alert, "chat"); status != StatusThrottled {
+			t.Errorf("%s: %q", alert, status)
+		}
+	}
+	// отложенное уведомление сохраняется в расписании
+	if count, err := ts.config.Store.CountScheduled(); err != nil || count != 1 {
+		t.Errorf("scheduled: %d, %v", count, err)
+	}
+	requests := wait(2)
+	if !strings.Contains(string(requests[1].Payload), "third") {
+		t.Errorf("coalesced payload: %s", requests[1].Payload)
+	}
+	// уведомления без collapseId откладываются по очереди
+	time.Sleep(window)
+	ts.apns.Reset()
+	for _, alert := range []string{"one", "two", "three"} {
+		push(alert, "")
+	}
+	requests = wait(3)
+	for i, alert := range []string{"one", "two", "three"} {
+		if !strings.Contains(string(requests[i].Payload), alert) {
+			t.Errorf("deferred payload %d: %s", i, requests[i].Payload)
+		}
+	}
+	// отказ APNS из-за частой отправки откладывает уведомление
+	time.Sleep(window)
+	ts.apns.Reset()
+	ts.apns.Respond("AAAA", mockapns.TooManyRequests, mockapns.OK)
+	if status := push("retry", ""); status != StatusThrottled {
+		t.Errorf("too many requests: %q", status)
+	}
+	wait(2)
+	if tokens := ts.tokens("dmitrys", false); len(tokens) != 1 {
+		t.Errorf("tokens: %v", tokens)
+	}
+}
+
+func TestThrottleClean(t *testing.T) {
+	const window = 20 * time.Millisecond
+	throttle := newTokenThrottle(&Config{
+		Throttle: &ThrottleConfig{Window: Duration(window)},
+	})
+	defer throttle.Close()
+	for _, token := range []string{"AAAA", "BBBB", "CCCC"} {
+		if !throttle.Allow(Notification{Topic: testTopic, Token: token}) {
+			t.Errorf("%s: throttled", token)
+		}
+	}
+	// время отправок удаляется после окончания интервала
+	for deadline := time.Now().Add(50 * window); time.Now().Before(deadline); {
+		throttle.mu.Lock()
+		sent, sweep := len(throttle.sent), throttle.sweep
+		throttle.mu.Unlock()
+		if sent == 0 && sweep == nil {
+			return
+		}
+		time.Sleep(window)
+	}
+	t.Error("expired sends not removed")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig описывает настройки защищенного соединения сервиса.
+//
+// Если заданы файлы с сертификатом и ключом, то используются они. Иначе, если
+// задан список имен хостов, то сертификаты автоматически получаются через
+// ACME (Let's Encrypt или совместимый сервер). Если не задано ни то, ни
+// другое, то используется встроенный сертификат для localhost (только для
+// отладки).
+type TLSConfig struct {
+	CertFile     string   `json:"certFile,omitempty"`     // файл с сертификатом
+	KeyFile      string   `json:"keyFile,omitempty"`      // файл с ключом
+	Hosts        []string `json:"hosts,omitempty"`        // имена хостов для ACME
+	Email        string   `json:"email,omitempty"`        // контактный email для ACME
+	CacheDir     string   `json:"cacheDir,omitempty"`     // каталог для кеша сертификатов
+	DirectoryURL string   `json:"directoryURL,omitempty"` // адрес каталога ACME
+	MinVersion   string   `json:"minVersion,omitempty"`   // минимальная версия TLS
+	Redirect     bool     `json:"redirect,omitempty"`     // перенаправление с HTTP
+	ClientCA     string   `json:"clientCA,omitempty"`     // файл с сертификатами CA клиентов
+	ClientAuth   string   `json:"clientAuth,omitempty"`   // режим проверки клиентов
+}
+
+// defaultACMECache задает каталог для кеша сертификатов ACME по умолчанию.
+const defaultACMECache = "letsEncript.cache"
+
+// clientAuthTypes содержит поддерживаемые режимы проверки клиентских
+// сертификатов: verify проверяет сертификат, если клиент его передал, а require
+// требует обязательного наличия сертификата.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":        tls.VerifyClientCertIfGiven,
+	"verify":  tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// tlsVersions содержит поддерживаемые названия версий TLS.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config возвращает настройки TLS для HTTP-сервера и обработчик для
+// HTTP-сервера перенаправления на HTTPS. При использовании ACME этот
+// обработчик так же отвечает на проверки http-01.
+func (t *TLSConfig) Config() (*tls.Config, http.Handler, error) {
+	var (
+		config   = new(tls.Config)
+		redirect = http.Handler(http.HandlerFunc(redirectHTTPS))
+	)
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported tls version %q", t.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if t.ClientCA != "" {
+		authType, ok := clientAuthTypes[t.ClientAuth]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported client auth %q", t.ClientAuth)
+		}
+		data, err := ioutil.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificates in %s", t.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = authType
+	}
+	switch {
+	case t.CertFile != "" || t.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case len(t.Hosts) > 0:
+		var cacheDir = t.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultACMECache
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.Hosts...),
+			Email:      t.Email,
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		if t.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: t.DirectoryURL}
+		}
+		config.GetCertificate = manager.GetCertificate
+		config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		redirect = manager.HTTPHandler(redirect)
+	default:
+		// исключительно для отладки
+		cert, err := tls.X509KeyPair(LocalhostCert, LocalhostKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("local certificates error: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, redirect, nil
+}
+
+// redirectHTTPS перенаправляет HTTP-запрос на тот же адрес по HTTPS.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "https://"+r.Host+r.URL.String(),
+		http.StatusMovedPermanently)
+}
+
+// certificateNames возвращает список имен, которыми может быть идентифицирован
+// клиентский сертификат: имя субъекта (CN), DNS-имена, email и URI из SAN.
+func certificateNames(cert *x509.Certificate) []string {
+	var names = make([]string, 0, 1+len(cert.DNSNames)+
+		len(cert.EmailAddresses)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+// VoIPExpiration задает время жизни уведомления о входящем звонке по
+// умолчанию: после этого времени звонок уже не актуален.
+var VoIPExpiration = time.Second * 30
+
+// PushCall отправляет VoIP-уведомление о входящем звонке на все VoIP-токены
+// пользователя. Уведомление всегда отправляется с высоким приоритетом.
+func (s *Service) PushCall(c *rest.Context) error {
+	// проверяем авторизацию пользователя
+	if err := s.UserAuth(c); err != nil {
+		return err
+	}
+	user := c.Param("login") // логин пользователя
+	if user == "" {
+		return rest.ErrNotFound
+	}
+	topic := c.Param("topic") // тема
+	if topic == "" {
+		return c.Error(http.StatusNotFound, "empty topic")
+	}
+	query := c.Request.URL.Query()        // разобранные параметры запроса
+	sandbox := len(query["sandbox"]) != 0 // флаг sandbox
+	// получаем список VoIP-токенов пользователя
+	tokens, err := s.config.Store.GetUserTokens(TokenVoIP, topic, sandbox, user)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("voip tokens for user %s not registered", user))
+	}
+	// разбираем запроса для отправки уведомления
+	if err := validateBody(c, "PushRequest"); err != nil {
+		return err
+	}
+	var notification = new(pushRequest)
+	err = c.Bind(notification)
+	if err != nil {
+		return err
+	}
+	notification.PushType = PushVoIP
+	notification.LowPriority = false
+	if notification.Expiration.IsZero() {
+		notification.Expiration = time.Now().Add(VoIPExpiration)
+	}
+	n, err := notification.Notification(topic, sandbox)
+	if err != nil {
+		return payloadError(c, err)
+	}
+	if err := reserveUsage(c, len(tokens)); err != nil {
+		return err
+	}
+	sent, err := s.config.Push(n, tokens)
+	return writeSent(c, sent, err)
+}
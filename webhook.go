@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// События, о которых сервис уведомляет подписчиков.
+const (
+	EventTokenRemoved  = "token.removed"  // токен удален после ошибки APNS
+	EventPushFailed    = "push.failed"    // уведомление не отправлено
+	EventPushDelivered = "push.delivered" // уведомление принято APNS
+	EventJobCompleted  = "job.completed"  // задача рассылки завершена
+)
+
+// Статусы доставки событий подписчикам.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	// WebhookAttempts задает максимальное количество попыток доставки события.
+	WebhookAttempts = 5
+	// WebhookBackoff задает задержку перед второй попыткой доставки. Перед
+	// каждой следующей попыткой задержка удваивается.
+	WebhookBackoff = time.Second * 10
+	// WebhookLogSize задает количество последних доставок, сохраняемых в
+	// журнале.
+	WebhookLogSize = 1000
+)
+
+const (
+	webhookWorkers   = 4   // количество одновременных доставок
+	webhookBatchSize = 100 // событий, сохраняемых в журнале за раз
+)
+
+// httpWebhookClient http.Client для доставки событий подписчикам.
+var httpWebhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// Webhook описывает подписку на события сервиса. Пустой список событий или
+// тем означает подписку на все.
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // ключ подписи HMAC-SHA256
+	Events []string `json:"events,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// Match возвращает true, если подписка включает событие указанной темы.
+func (w *Webhook) Match(event, topic string) bool {
+	return matchAny(w.Events, event) && (topic == "" || matchAny(w.Topics, topic))
+}
+
+// matchAny возвращает true, если список пустой или содержит значение.
+func matchAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign возвращает значение заголовка X-Pusher-Signature для тела запроса.
+// Если ключ подписи не задан, то возвращается пустая строка.
+func (w *Webhook) Sign(body []byte) string {
+	if w.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivery описывает доставку события подписчику. Webhook содержит номер
+// подписки в конфигурации: у разных подписок может быть один адрес.
+type Delivery struct {
+	ID       string          `json:"id"`
+	Event    string          `json:"event"`
+	Webhook  int             `json:"webhook"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Status   string          `json:"status"`
+	Attempts int             `json:"attempts"`
+	Code     int             `json:"code,omitempty"` // HTTP-статус ответа
+	Error    string          `json:"error,omitempty"`
+	Created  time.Time       `json:"created"`
+	Updated  time.Time       `json:"updated"`
+}
+
+// webhookEvent описывает тело запроса с событием.
+type webhookEvent struct {
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+// pushEvent описывает данные событий отправки уведомления и удаления токена.
+type pushEvent struct {
+	Topic     string `json:"topic"`
+	Token     string `json:"token"`
+	Sandbox   bool   `json:"sandbox,omitempty"`
+	ID        string `json:"id,omitempty"`        // apns-id уведомления
+	Status    int    `json:"status,omitempty"`    // HTTP-статус ответа APNS
+	Reason    string `json:"reason,omitempty"`    // причина ошибки APNS
+	Timestamp int64  `json:"timestamp,omitempty"` // время отзыва токена
+	Error     string `json:"error,omitempty"`
+}
+
+// webhookSender доставляет события подписчикам в фоне.
+type webhookSender struct {
+	config *Config
+	events chan *Delivery // новые доставки для сохранения в журнале
+	queue  chan string    // идентификаторы доставок
+	stop   chan struct{}  // закрывается при остановке
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// newWebhookSender запускает обработчики доставки событий.
+func newWebhookSender(config *Config) *webhookSender {
+	var sender = &webhookSender{
+		config: config,
+		events: make(chan *Delivery, 1024),
+		queue:  make(chan string, 1024),
+		stop:   make(chan struct{}),
+	}
+	sender.wg.Add(webhookWorkers + 1)
+	go sender.saver()
+	for i := 0; i < webhookWorkers; i++ {
+		go sender.worker()
+	}
+	return sender
+}
+
+// Close останавливает доставку событий и дожидается завершения текущих
+// запросов. Недоставленные события остаются в журнале и отправляются после
+// перезапуска.
+func (s *webhookSender) Close() {
+	s.once.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+// Resume ставит в очередь доставки, не завершенные до остановки сервиса.
+// Очередь заполняется в фоне, чтобы не задерживать запуск сервиса.
+func (s *webhookSender) Resume() error {
+	deliveries, err := s.config.Store.GetDeliveries(0, func(d *Delivery) bool {
+		return d.Status == DeliveryPending
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		// журнал отдается от новых к старым
+		for i := len(deliveries) - 1; i >= 0; i-- {
+			s.enqueue(deliveries[i].ID)
+		}
+	}()
+	return nil
+}
+
+// Emit передает событие для всех подходящих подписок на сохранение в журнале
+// и доставку. Журнал записывается в фоне, поэтому Emit не ждет обращения к
+// хранилищу, пока очередь событий не переполнена.
+func (s *webhookSender) Emit(event, topic string, data interface{}) {
+	var payload []byte
+	for i, webhook := range s.config.Webhooks {
+		if !webhook.Match(event, topic) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(&webhookEvent{
+				Event:   event,
+				Created: time.Now().UTC(),
+				Data:    data,
+			})
+			if err != nil {
+				log.WithFields(log.Fields{
+					"event": event,
+					"url":   webhook.URL,
+				}).WithError(err).Error("webhook event error")
+				return
+			}
+		}
+		var now = time.Now().UTC()
+		var delivery = &Delivery{
+			Event:   event,
+			Webhook: i,
+			URL:     webhook.URL,
+			Payload: payload,
+			Status:  DeliveryPending,
+			Created: now,
+			Updated: now,
+		}
+		// после остановки события не принимаются
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		select {
+		case <-s.stop:
+			return
+		case s.events <- delivery:
+		}
+	}
+}
+
+// saver сохраняет новые доставки в журнале пачками и ставит их в очередь на
+// доставку. При остановке сохраняются все уже переданные события.
+func (s *webhookSender) saver() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			for {
+				select {
+				case delivery := <-s.events:
+					s.save(delivery)
+				default:
+					return
+				}
+			}
+		case delivery := <-s.events:
+			s.save(delivery)
+		}
+	}
+}
+
+// save сохраняет доставку в журнале вместе с остальными ожидающими
+// сохранения, но не более webhookBatchSize за раз.
+func (s *webhookSender) save(delivery *Delivery) {
+	var batch = []*Delivery{delivery}
+collect:
+	for len(batch) < webhookBatchSize {
+		select {
+		case delivery := <-s.events:
+			batch = append(batch, delivery)
+		default:
+			break collect
+		}
+	}
+	if err := s.config.Store.SaveDeliveries(batch...); err != nil {
+		log.WithField("events", len(batch)).WithError(err).
+			Error("save webhook delivery error")
+		return
+	}
+	for _, delivery := range batch {
+		s.enqueue(delivery.ID)
+	}
+}
+
+// enqueue ставит доставку в очередь. Если очередь переполнена, то enqueue
+// ждет, пока обработчики ее освободят, поэтому доставка не теряется до
+// перезапуска сервиса. Сами обработчики ставят повторные попытки в очередь
+// только из отдельной горутины.
+func (s *webhookSender) enqueue(id string) {
+	select {
+	case <-s.stop:
+	case s.queue <- id:
+	}
+}
+
+// worker выполняет доставки из очереди.
+func (s *webhookSender) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case id := <-s.queue:
+			s.deliver(id)
+		}
+	}
+}
+
+// deliver выполняет попытку доставки события и сохраняет ее результат. В
+// случае ошибки следующая попытка планируется с удвоенной задержкой.
+func (s *webhookSender) deliver(id string) {
+	ctxlog := log.WithField("delivery", id)
+	delivery, err := s.config.Store.GetDelivery(id)
+	if err != nil {
+		ctxlog.WithError(err).Error("get webhook delivery error")
+		return
+	}
+	if delivery == nil || delivery.Status != DeliveryPending {
+		return
+	}
+	ctxlog = ctxlog.WithFields(log.Fields{
+		"event": delivery.Event,
+		"url":   delivery.URL,
+	})
+	delivery.Attempts++
+	delivery.Code, err = s.post(delivery)
+	delivery.Updated = time.Now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.Error = ""
+		ctxlog.Debug("webhook delivered")
+	case delivery.Attempts >= WebhookAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+		ctxlog.WithError(err).Error("webhook delivery failed")
+	default:
+		delivery.Error = err.Error()
+		var backoff = WebhookBackoff << uint(delivery.Attempts-1)
+		ctxlog.WithError(err).WithField("retry", backoff).Warning("webhook error")
+		time.AfterFunc(backoff, func() { s.enqueue(id) })
+	}
+	if err := s.config.Store.SaveDelivery(delivery); err != nil {
+		ctxlog.WithError(err).Error("save webhook delivery error")
+	}
+}
+
+// post отправляет событие подписчику и возвращает HTTP-статус ответа. Ответ
+// с кодом, отличным от 2xx, считается ошибкой.
+func (s *webhookSender) post(delivery *Delivery) (int, error) {
+	// подписка могла измениться после перезапуска сервиса
+	var webhooks = s.config.Webhooks
+	if delivery.Webhook < 0 || delivery.Webhook >= len(webhooks) ||
+		webhooks[delivery.Webhook].URL != delivery.URL {
+		return 0, fmt.Errorf("webhook %s not configured", delivery.URL)
+	}
+	var webhook = webhooks[delivery.Webhook]
+	req, err := http.NewRequest(http.MethodPost, delivery.URL,
+		bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("User-Agent", agent)
+	req.Header.Set("X-Pusher-Event", delivery.Event)
+	req.Header.Set("X-Pusher-Delivery", delivery.ID)
+	if signature := webhook.Sign(delivery.Payload); signature != "" {
+		req.Header.Set("X-Pusher-Signature", signature)
+	}
+	resp, err := httpWebhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// emit отправляет событие подписчикам, если доставка событий запущена.
+func (c *Config) emit(event, topic string, data interface{}) {
+	if c.hooks != nil && len(c.Webhooks) > 0 {
+		c.hooks.Emit(event, topic, data)
+	}
+}
+
+// GetWebhooks отдает список подписок без ключей подписи.
+func (s *Service) GetWebhooks(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	var list = make([]Webhook, len(s.config.Webhooks))
+	for i, webhook := range s.config.Webhooks {
+		list[i] = *webhook
+		list[i].Secret = ""
+	}
+	return c.Write(rest.JSON{"webhooks": list})
+}
+
+// GetDeliveries отдает журнал доставки событий от новых к старым. Параметры
+// event и status ограничивают список, limit задает его размер (по умолчанию
+// 100).
+func (s *Service) GetDeliveries(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	query := c.Request.URL.Query()
+	event, status := query.Get("event"), query.Get("status")
+	var limit = 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return c.Error(http.StatusBadRequest, "bad limit")
+		}
+	}
+	deliveries, err := s.config.Store.GetDeliveries(limit, func(d *Delivery) bool {
+		return (event == "" || d.Event == event) &&
+			(status == "" || d.Status == status)
+	})
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"deliveries": deliveries})
+}
+
+// Redeliver повторно ставит событие из журнала в очередь на доставку.
+func (s *Service) Redeliver(c *rest.Context) error {
+	// проверяем авторизацию администратора
+	if err := s.AdminAuth(c); err != nil {
+		return err
+	}
+	if s.config.hooks == nil {
+		return c.Error(http.StatusServiceUnavailable, "webhooks not started")
+	}
+	delivery, err := s.config.Store.GetDelivery(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if delivery == nil {
+		return c.Error(http.StatusNotFound,
+			fmt.Sprintf("delivery %s not found", c.Param("id")))
+	}
+	delivery.Status = DeliveryPending
+	delivery.Attempts = 0
+	delivery.Error = ""
+	delivery.Updated = time.Now().UTC()
+	if err := s.config.Store.SaveDelivery(delivery); err != nil {
+		return err
+	}
+	s.config.hooks.enqueue(delivery.ID)
+	c.SetStatus(http.StatusAccepted)
+	return c.Write(rest.JSON{"delivery": delivery})
+}
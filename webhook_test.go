@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdigger/pusher/mockapns"
+)
+
+// webhookReceiver принимает события и проверяет их подпись.
+type webhookReceiver struct {
+	*httptest.Server
+	events map[string][]json.RawMessage // данные событий по названию
+	fail   int                          // количество ответов с ошибкой
+	mu     sync.Mutex
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	var receiver = &webhookReceiver{events: make(map[string][]json.RawMessage)}
+	var webhook = &Webhook{Secret: secret}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if sign := r.Header.Get("X-Pusher-Signature"); sign != webhook.Sign(body) {
+				t.Errorf("bad signature %q", sign)
+			}
+			receiver.mu.Lock()
+			defer receiver.mu.Unlock()
+			if receiver.fail > 0 {
+				receiver.fail--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var event webhookEvent
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Errorf("bad event %s: %v", body, err)
+			}
+			if event.Event != r.Header.Get("X-Pusher-Event") {
+				t.Errorf("event %q, header %q", event.Event,
+					r.Header.Get("X-Pusher-Event"))
+			}
+			data, _ := json.Marshal(event.Data)
+			receiver.events[event.Event] = append(receiver.events[event.Event], data)
+		}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// wait ожидает получения указанного количества событий.
+func (r *webhookReceiver) wait(t *testing.T, event string, count int) []json.RawMessage {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		r.mu.Lock()
+		events := r.events[event]
+		r.mu.Unlock()
+		if len(events) >= count {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: events not received", event)
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	backoff := WebhookBackoff
+	WebhookBackoff = 10 * time.Millisecond
+	defer func() { WebhookBackoff = backoff }()
+
+	receiver := newWebhookReceiver(t, "secret")
+	receiver.fail = 2 // первые попытки доставки завершаются ошибкой
+	other := newWebhookReceiver(t, "")
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Webhooks = []*Webhook{
+			{URL: receiver.URL, Secret: "secret", Events: []string{
+				EventTokenRemoved, EventPushFailed}},
+			{URL: other.URL, Topics: []string{"com.example.other"}},
+		}
+	})
+	ts.addTokens("dmitrys", false, "AAAA", "BBBB")
+	ts.apns.Respond("BBBB", mockapns.Unregistered(time.Now()))
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		testPayload)
+
+	var removed pushEvent
+	json.Unmarshal(receiver.wait(t, EventTokenRemoved, 1)[0], &removed)
+	if removed.Token != "BBBB" || removed.Topic != testTopic ||
+		removed.Reason != "Unregistered" || removed.Timestamp == 0 {
+		t.Errorf("token.removed: %+v", removed)
+	}
+	var failed pushEvent
+	json.Unmarshal(receiver.wait(t, EventPushFailed, 1)[0], &failed)
+	if failed.Token != "BBBB" || failed.Status != http.StatusGone {
+		t.Errorf("push.failed: %+v", failed)
+	}
+	// журнал доставки: результат сохраняется после ответа подписчика
+	var data struct {
+		Deliveries []*Delivery `json:"deliveries"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		data.Deliveries = nil
+		ts.expect(http.StatusOK, "GET", "/webhooks/deliveries?status=delivered",
+			nil).Decode(t, &data)
+		if len(data.Deliveries) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries: %d", len(data.Deliveries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var attempts int
+	for _, delivery := range data.Deliveries {
+		attempts += delivery.Attempts
+		if delivery.URL != receiver.URL {
+			t.Errorf("delivery url: %s", delivery.URL)
+		}
+	}
+	if attempts != 4 {
+		t.Errorf("delivery attempts: %d", attempts)
+	}
+	// повторная доставка
+	id := data.Deliveries[0].ID
+	ts.expect(http.StatusAccepted, "POST", "/webhooks/deliveries/"+id, nil)
+	receiver.wait(t, data.Deliveries[0].Event, 2)
+	ts.expect(http.StatusNotFound, "POST", "/webhooks/deliveries/unknown", nil)
+	// подписки отдаются без ключей
+	resp := ts.expect(http.StatusOK, "GET", "/webhooks", nil)
+	var webhooks struct {
+		Webhooks []*Webhook `json:"webhooks"`
+	}
+	resp.Decode(t, &webhooks)
+	if len(webhooks.Webhooks) != 2 || webhooks.Webhooks[0].Secret != "" {
+		t.Errorf("webhooks: %+v", webhooks.Webhooks)
+	}
+	// события другой темы не отправляются
+	other.mu.Lock()
+	if len(other.events) != 0 {
+		t.Errorf("other topic events: %v", other.events)
+	}
+	other.mu.Unlock()
+}
+
+func TestWebhookSenderClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	receiver := newWebhookReceiver(t, "")
+	var config = &Config{
+		Store:    store,
+		Webhooks: []*Webhook{{URL: receiver.URL}},
+	}
+	sender := newWebhookSender(config)
+	const count = 300
+	for i := 0; i < count; i++ {
+		sender.Emit(EventPushDelivered, testTopic, &pushEvent{Token: "AAAA"})
+	}
+	// переданные события сохраняются в журнале и после остановки
+	sender.Close()
+	sender.Emit(EventPushDelivered, testTopic, &pushEvent{Token: "BBBB"})
+	deliveries, err := store.GetDeliveries(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != count {
+		t.Errorf("deliveries: %d", len(deliveries))
+	}
+}
+
+func TestWebhooksSameURL(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	ts := newTestServiceConfig(t, func(config *Config) {
+		config.Webhooks = []*Webhook{
+			{URL: receiver.URL, Secret: "other", Events: []string{EventJobCompleted}},
+			{URL: receiver.URL, Secret: "secret", Events: []string{EventPushDelivered}},
+		}
+	})
+	ts.addTokens("dmitrys", false, "AAAA")
+	ts.expect(http.StatusOK, "POST", "/apns/"+testTopic+"/users/dmitrys/push",
+		testPayload)
+	// событие подписано ключом своей подписки
+	receiver.wait(t, EventPushDelivered, 1)
+	var data struct {
+		Deliveries []*Delivery `json:"deliveries"`
+	}
+	ts.expect(http.StatusOK, "GET", "/webhooks/deliveries", nil).Decode(t, &data)
+	if len(data.Deliveries) != 1 || data.Deliveries[0].Webhook != 1 {
+		t.Errorf("deliveries: %+v", data.Deliveries)
+	}
+}
+
+func TestWebhookLogPending(t *testing.T) {
+	size := WebhookLogSize
+	WebhookLogSize = 2
+	defer func() { WebhookLogSize = size }()
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// из журнала удаляются старые записи, но не ожидающие доставки
+	var pending = &Delivery{Status: DeliveryPending}
+	if err := store.SaveDeliveries(pending, &Delivery{Status: DeliveryDelivered},
+		&Delivery{Status: DeliveryFailed}, &Delivery{Status: DeliveryDelivered},
+		&Delivery{Status: DeliveryDelivered}); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := store.GetDeliveries(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 || deliveries[2].ID != pending.ID {
+		t.Errorf("deliveries: %+v", deliveries)
+	}
+}